@@ -4,183 +4,492 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/hashicorp/hcl"
 	"gopkg.in/resty.v1"
-	"io/ioutil"
-	"math/rand"
+	"log"
 	"net/http"
-	"strconv"
+	"net/url"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-var connection *resty.Client
-var datastores []string
-var credentials map[string]string
-var server string
+// Client carries the vCenter settings for a configured provider instance and
+// is handed to data sources as their meta value.
+//
+// Each provider instance (including aliases) gets its own Client, so the
+// session and the datastore cache are never shared between vCenters.
+//
+// Terraform doesn't tell a provider when it is done with it, so the session
+// is ended when the last data source read using it finishes; reads wrap
+// their requests in acquire and release. Stopping the provider ends the
+// session straight away and no new one is started.
+type Client struct {
+	server    string
+	user      string
+	password  string
+	tlsConfig *tls.Config
 
-var connectOnce sync.Once
-var dsOnce sync.Once
+	connection *resty.Client
+	readers    int                    // reads using the session
+	stopped    bool                   // set once Terraform stops the provider
+	datastores map[string][]datastore // by filter
 
-var tfvarsOnce sync.Once
-var tfdomainOnce sync.Once
+	// now is the clock used for expiry, replaceable in tests.
+	now func() time.Time
 
-func getCredentials() map[string]string {
-	tfvarsOnce.Do(func() {
-		credentials = make(map[string]string, 2)
-		data, err := ioutil.ReadFile("terraform.tfvars")
-		if err != nil {
-			panic(fmt.Sprintf("failed to read terraform.tfvars file - %v", err.Error()))
-		}
+	mu sync.Mutex
+}
 
-		tfvars := make(map[string]interface{}, 0)
-		err = hcl.Unmarshal(data, &tfvars)
-		if err != nil {
-			panic(fmt.Sprintf("failed to parse terraform.tfvars file", err.Error()))
-		}
-		credentials["user"] = tfvars["vsphere_user"].(string)
-		credentials["pass"] = tfvars["vsphere_password"].(string)
-	})
+// clock returns the current time.
+func (c *Client) clock() time.Time {
+	if c.now == nil {
+		return time.Now()
+	}
+	return c.now()
+}
 
-	return credentials
+func (c *Client) url(path string) string {
+	return fmt.Sprintf("https://%v/rest/%v", c.server, path)
 }
 
-func getDomain() string {
-	tfdomainOnce.Do(func() {
-		data, err := ioutil.ReadFile("variables.tf")
-		if err != nil {
-			panic(fmt.Sprintf("failed to read variables.tf file - %v", err.Error()))
-		}
+func (c *Client) error(url string, status int, err error) *APIError {
+	return &APIError{Host: c.server, URL: url, Status: status, Err: err}
+}
 
-		tfvars := make(map[string]interface{}, 0)
-		err = hcl.Unmarshal(data, &tfvars)
-		if err != nil {
-			panic(fmt.Sprintf("failed to parse variables.tf file", err.Error()))
-		}
-		variable := tfvars["variable"].([]map[string]interface{})
-		vserver := variable[0]["vsphere_server"].([]map[string]interface{})
-		server = vserver[0]["default"].(string)
-	})
-	return server
+// responseError returns an error for a response with a failure status, using
+// the vAPI error in the body when there is one.
+func (c *Client) responseError(url string, resp *resty.Response) error {
+	if resp.StatusCode() < 300 {
+		return nil
+	}
+	if err := decodeVAPIError(resp.Body()); err != nil {
+		return advise(c.error(url, resp.StatusCode(), err))
+	}
+	return advise(c.error(url, resp.StatusCode(), fmt.Errorf("%s", resp.Status())))
 }
 
-func connect(domain string) *resty.Client {
-	credentials := getCredentials()
-	connectOnce.Do(func() {
-		connection = resty.New()
-		connection.SetTLSClientConfig(&tls.Config{InsecureSkipVerify: true})
-		connection.SetBasicAuth(credentials["user"], credentials["pass"])
-		connection.RemoveProxy()
-		resp, err := connection.R().Post(fmt.Sprintf("https://%v/rest/com/vmware/cis/session", domain))
-		if err != nil {
-			panic("failed to connect: " + err.Error())
-		}
-		data := make(map[string]interface{}, 0)
-		if err := json.Unmarshal(resp.Body(), &data); err != nil {
-			panic(err.Error())
-		}
+// connect returns the current session, logging in first if there isn't one.
+func (c *Client) connect() (*resty.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connection != nil {
+		return c.connection, nil
+	}
+	return c.login()
+}
+
+// reconnect replaces a session that vCenter no longer accepts. When several
+// requests notice the same expired session only the first logs in again; the
+// rest pick up the new session.
+func (c *Client) reconnect(stale *resty.Client) (*resty.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.connection != nil && c.connection != stale {
+		return c.connection, nil
+	}
+	log.Printf("[INFO] vCenter session on %s expired, logging in again", c.server)
+	return c.login()
+}
+
+// login creates a new session and must be called with c.mu held.
+func (c *Client) login() (*resty.Client, error) {
+	c.connection = nil
+	if c.stopped {
+		return nil, fmt.Errorf("not logging in to %s: the provider is stopping", c.server)
+	}
+
+	connection := resty.New()
+	connection.SetTLSClientConfig(c.tlsConfig)
+	connection.RemoveProxy()
+
+	var url = c.url("com/vmware/cis/session")
+	resp, err := connection.R().
+		SetBasicAuth(c.user, c.password).
+		Post(url)
+	if err != nil {
+		return nil, c.error(url, 0, fmt.Errorf("failed to connect: %s", err))
+	}
+	if err := c.responseError(url, resp); err != nil {
+		return nil, err
+	}
+	data := make(map[string]interface{}, 0)
+	if err := json.Unmarshal(resp.Body(), &data); err != nil {
+		return nil, c.error(url, resp.StatusCode(), fmt.Errorf("invalid session response: %s", err))
+	}
+	session, ok := data["value"].(string)
+	if !ok {
+		return nil, c.error(url, resp.StatusCode(), fmt.Errorf("session response has no session id"))
+	}
 
-		connection.SetCookie(&http.Cookie{
-			Name:     "vmware-api-session-id",
-			Value:    data["value"].(string),
-			Path:     "/",
-			Domain:   domain,
-			MaxAge:   36000,
-			HttpOnly: false,
-			Secure:   true,
-		})
+	connection.SetCookie(&http.Cookie{
+		Name:     "vmware-api-session-id",
+		Value:    session,
+		Path:     "/",
+		Domain:   c.server,
+		MaxAge:   36000,
+		HttpOnly: false,
+		Secure:   true,
 	})
-	return connection
+	c.connection = connection
+	return c.connection, nil
+}
+
+// acquire marks the start of a read that uses the session.
+func (c *Client) acquire() {
+	c.mu.Lock()
+	c.readers++
+	c.mu.Unlock()
 }
 
-func query(what string) map[string]interface{} {
-	var domain = getDomain()
-	var url = fmt.Sprintf("https://%v/rest/vcenter/%v", domain, what)
-	resp, err := connect(domain).R().
+// release marks the end of a read, ending the session when no other read is
+// using it.
+func (c *Client) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.readers--; c.readers > 0 {
+		return
+	}
+	if err := c.logout(); err != nil {
+		log.Printf("[WARN] %s", err)
+	}
+}
+
+// stop ends the session when Terraform stops the provider. Requests still
+// in flight fail rather than logging in again.
+func (c *Client) stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stopped = true
+	return c.logout()
+}
+
+// logout ends the current session, if any, and must be called with c.mu
+// held.
+func (c *Client) logout() error {
+	if c.connection == nil {
+		return nil
+	}
+
+	var url = c.url("com/vmware/cis/session")
+	resp, err := c.connection.R().Delete(url)
+	c.connection = nil
+	if err != nil {
+		return c.error(url, 0, fmt.Errorf("failed to log out: %s", err))
+	}
+	if resp.StatusCode() == http.StatusUnauthorized {
+		// the session had already expired
+		return nil
+	}
+	return c.responseError(url, resp)
+}
+
+// get performs a GET against the API, logging in again and retrying once if
+// the session has expired.
+func (c *Client) get(url string) (*resty.Response, error) {
+	return c.request(http.MethodGet, url)
+}
+
+// request performs a request against the API, logging in again and retrying
+// once if the session has expired.
+func (c *Client) request(method, url string) (*resty.Response, error) {
+	connection, err := c.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := connection.R().
 		SetHeader("Accept", "application/json").
-		Get(url)
+		Execute(method, url)
 	if err != nil {
-		panic("failed to connect: " + err.Error())
+		return nil, c.error(url, 0, fmt.Errorf("failed to connect: %s", err))
+	}
+	if resp.StatusCode() != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	if connection, err = c.reconnect(connection); err != nil {
+		return nil, err
+	}
+	resp, err = connection.R().
+		SetHeader("Accept", "application/json").
+		Execute(method, url)
+	if err != nil {
+		return nil, c.error(url, 0, fmt.Errorf("failed to connect: %s", err))
+	}
+	return resp, nil
+}
+
+// query fetches a vcenter endpoint and returns the contents of the "value"
+// field that wraps every vAPI response.
+func (c *Client) query(what string) (interface{}, error) {
+	return c.value(http.MethodGet, "vcenter/"+what)
+}
+
+// value requests an API path and returns the contents of the "value" field
+// of the response.
+func (c *Client) value(method, path string) (interface{}, error) {
+	var url = c.url(path)
+	resp, err := c.request(method, url)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.responseError(url, resp); err != nil {
+		return nil, err
 	}
 	// Unmarshal the VM to an interface
 	data := make(map[string]interface{}, 0)
 	if err = json.Unmarshal(resp.Body(), &data); err != nil {
-		panic(err.Error())
+		return nil, c.error(url, resp.StatusCode(), fmt.Errorf("invalid JSON response: %s", err))
+	}
+	value, ok := data["value"]
+	if !ok {
+		return nil, c.error(url, resp.StatusCode(), fmt.Errorf("response has no value field"))
 	}
-	return data
+	return value, nil
 }
 
-func getClusterPrefix() string {
-	return "Odd" // should come from config h/c for now
+// vmDisk is a virtual disk of an existing VM.
+//
+// Thin or thick provisioning isn't reported: the REST disk backing only has
+// a type and vmdk_file, and the provisioning is only available through the
+// SOAP API.
+type vmDisk struct {
+	label          string // informational only; labels are localised and can be renamed
+	vmdk           datastorePath
+	capacity       int64  // bytes
+	bus            string // controller type, e.g. "scsi"
+	number         int    // controller bus number
+	unit           int
+	controllerType string // adapter model, e.g. "pvscsi" or "ahci"
 }
 
-func getDatastores(prefix string) []string {
-	dsOnce.Do(func() {
-		var ds = query("datastore")["value"].([]interface{})
-		datastores = make([]string, 0)
-		//var prefix = getClusterPrefix()
-		for _, value := range ds {
-			name := value.(map[string]interface{})["name"].(string)
-			if strings.HasPrefix(name, prefix) {
-				datastores = append(datastores, name)
-			}
-		}
-	})
-	return datastores
+// controller returns the controller type and bus, e.g. "scsi0".
+func (d vmDisk) controller() string {
+	if d.bus == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s%d", d.bus, d.number)
 }
 
-func getDisks(data map[string]interface{}) []string {
-	var value = data["value"].(map[string]interface{})
-	var disks = value["disks"].([]interface{})
+// diskBusOrder sorts disks by controller type before bus and unit number.
+// Disks without a known address go last.
+var diskBusOrder = map[string]int{"scsi": 1, "sata": 2, "nvme": 3, "ide": 4}
 
-	var vmdks = make([]string, len(disks))
+// getDisks returns the disks of a VM ordered by controller and unit number,
+// e.g. scsi0:0, scsi0:1, scsi1:0, sata0:0.
+func getDisks(details map[string]interface{}) ([]vmDisk, error) {
+	disks, ok := details["disks"].([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("VM details have no disks list")
+	}
+
+	adapters := diskControllerTypes(details)
+	var vmdks = make([]vmDisk, 0, len(disks))
 	for _, v := range disks {
-		var dvalue = v.(map[string]interface{})["value"].(map[string]interface{})
-		var label = strings.Split(dvalue["label"].(string), " ")
-		index, err := strconv.Atoi(label[len(label)-1])
+		entry, _ := v.(map[string]interface{})
+		dvalue, ok := entry["value"].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("disk entry has no value")
+		}
+		text, _ := dvalue["label"].(string)
+		backing, _ := dvalue["backing"].(map[string]interface{})
+		file, ok := backing["vmdk_file"].(string)
+		if !ok {
+			return nil, &DiskError{Label: text, Err: fmt.Errorf("disk has no vmdk_file backing")}
+		}
+		vmdk, err := parseDatastorePath(file)
 		if err != nil {
-			panic("Hard disk label doesn't end in an integer")
+			return nil, &DiskError{Label: text, Err: err}
+		}
+		disk := vmDisk{label: text, vmdk: vmdk}
+		if n, ok := filterNumber(dvalue["capacity"]); ok {
+			disk.capacity = int64(n)
 		}
-		var backing = dvalue["backing"].(map[string]interface{})
-		vmdks[(index - 1)] = backing["vmdk_file"].(string)
+		disk.bus, disk.number, disk.unit = diskAddress(dvalue)
+		disk.controllerType = adapters[disk.controller()]
+		if disk.controllerType == "" {
+			disk.controllerType = disk.bus
+		}
+		vmdks = append(vmdks, disk)
 	}
-	return vmdks
+
+	sort.SliceStable(vmdks, func(i, j int) bool {
+		a, b := vmdks[i], vmdks[j]
+		if diskBusRank(a.bus) != diskBusRank(b.bus) {
+			return diskBusRank(a.bus) < diskBusRank(b.bus)
+		}
+		if a.number != b.number {
+			return a.number < b.number
+		}
+		return a.unit < b.unit
+	})
+	return vmdks, nil
 }
 
-func getLun(vmdk string) string {
-	return strings.TrimLeft(strings.TrimRight(vmdk, "]"), "[")
+func diskBusRank(bus string) int {
+	if rank, ok := diskBusOrder[bus]; ok {
+		return rank
+	}
+	return len(diskBusOrder) + 1
 }
 
-func getImage(vmdk string) string {
-	return strings.Split(strings.Split(vmdk, "/")[1], ".")[0]
+// diskAddress returns the controller type, bus number and unit number a disk
+// is attached to. IDE disks are addressed as primary or secondary, master or
+// slave.
+func diskAddress(dvalue map[string]interface{}) (string, int, int) {
+	kind, _ := dvalue["type"].(string)
+	kind = strings.ToLower(kind)
+	address, ok := dvalue[kind].(map[string]interface{})
+	if !ok {
+		return "", 0, 0
+	}
+	if kind == "ide" {
+		bus, unit := 1, 1
+		if primary, _ := address["primary"].(bool); primary {
+			bus = 0
+		}
+		if master, _ := address["master"].(bool); master {
+			unit = 0
+		}
+		return kind, bus, unit
+	}
+	bus, _ := filterNumber(address["bus"])
+	unit, _ := filterNumber(address["unit"])
+	return kind, int(bus), int(unit)
 }
 
-func getVm(vmname string) (string, error) {
-	vmids := query(fmt.Sprintf("vm?filter.names.1=%v", vmname))["value"].([]interface{})
+// diskControllerTypes returns the model of each SCSI and SATA adapter of a
+// VM, keyed by controller, e.g. "scsi0": "pvscsi".
+func diskControllerTypes(details map[string]interface{}) map[string]string {
+	types := make(map[string]string)
+	for _, kind := range []string{"scsi", "sata"} {
+		adapters, _ := details[kind+"_adapters"].([]interface{})
+		for _, a := range adapters {
+			entry, _ := a.(map[string]interface{})
+			value, _ := entry["value"].(map[string]interface{})
+			model, _ := value["type"].(string)
+			var bus float64
+			if kind == "scsi" {
+				address, _ := value["scsi"].(map[string]interface{})
+				bus, _ = filterNumber(address["bus"])
+			} else {
+				bus, _ = filterNumber(value["bus"])
+			}
+			types[fmt.Sprintf("%s%d", kind, int(bus))] = strings.ToLower(model)
+		}
+	}
+	return types
+}
+
+// vmSummary is the configuration of an existing VM, for comparison with its
+// inventory row.
+type vmSummary struct {
+	cpu     int
+	memory  int // MiB
+	power   string
+	guestOS string
+}
+
+var vmPowerStates = map[string]string{
+	"POWERED_ON":  "poweredOn",
+	"POWERED_OFF": "poweredOff",
+	"SUSPENDED":   "suspended",
+}
+
+func getVmSummary(details map[string]interface{}) vmSummary {
+	var summary vmSummary
+	cpu, _ := details["cpu"].(map[string]interface{})
+	if n, ok := filterNumber(cpu["count"]); ok {
+		summary.cpu = int(n)
+	}
+	memory, _ := details["memory"].(map[string]interface{})
+	if n, ok := filterNumber(memory["size_MiB"]); ok {
+		summary.memory = int(n)
+	}
+	power, _ := details["power_state"].(string)
+	summary.power = vmPowerStates[power]
+	summary.guestOS, _ = details["guest_OS"].(string)
+	return summary
+}
+
+func (c *Client) getVm(vmname string) (string, error) {
+	var what = fmt.Sprintf("vm?filter.names.1=%v", vmname)
+	value, err := c.query(what)
+	if err != nil {
+		return "", err
+	}
+	vmids, ok := value.([]interface{})
+	if !ok {
+		return "", c.error(c.url("vcenter/"+what), 0, fmt.Errorf("expected a list of VMs, got %T", value))
+	}
 	if 0 == len(vmids) {
 		// we would be able to continue here as we're probably creating...
-		fmt.Printf("[ERROR] - No VM found with name %v\n", vmname)
+		log.Printf("[INFO] No VM found with name %v", vmname)
 		return "", nil
 	} else if 1 != len(vmids) {
 		return "", fmt.Errorf("Multiple VMs found with name %v", vmname)
 	}
-	return vmids[0].(map[string]interface{})["vm"].(string), nil
+	entry, _ := vmids[0].(map[string]interface{})
+	vmid, ok := entry["vm"].(string)
+	if !ok {
+		return "", c.error(c.url("vcenter/"+what), 0, fmt.Errorf("VM entry has no id"))
+	}
+	return vmid, nil
 }
 
-func getVmDetails(vmid string) map[string]interface{} {
-	return query(fmt.Sprintf("vm/%v", vmid))
+func (c *Client) getVmDetails(vmid string) (map[string]interface{}, error) {
+	var what = fmt.Sprintf("vm/%v", vmid)
+	value, err := c.query(what)
+	if err != nil {
+		return nil, err
+	}
+	details, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, c.error(c.url("vcenter/"+what), 0, fmt.Errorf("expected VM details, got %T", value))
+	}
+	return details, nil
 }
 
-func getVmList() []string {
-	data := query("vm")["value"].([]interface{})
+// getVmList returns the names of the VMs matching filters, such as
+// "filter.clusters.1", or of every VM when filters is empty.
+func (c *Client) getVmList(filters url.Values) ([]string, error) {
+	what := "vm"
+	if len(filters) > 0 {
+		what += "?" + filters.Encode()
+	}
+	value, err := c.query(what)
+	if err != nil {
+		return nil, err
+	}
+	data, ok := value.([]interface{})
+	if !ok {
+		return nil, c.error(c.url("vcenter/"+what), 0, fmt.Errorf("expected a list of VMs, got %T", value))
+	}
 	vmlist := make([]string, len(data))
 	for i, value := range data {
-		vmlist[i] = value.(map[string]interface{})["name"].(string)
+		entry, _ := value.(map[string]interface{})
+		vmlist[i], _ = entry["name"].(string)
 	}
-	return vmlist
+	return vmlist, nil
 }
 
-func randomDS(clusterPrefix string) string {
-	datastores := getDatastores(clusterPrefix)
-	return datastores[rand.Intn(len(datastores))]
+// getNetworks returns the names of the networks on vCenter keyed by their
+// identifiers.
+func (c *Client) getNetworks() (map[string]string, error) {
+	value, err := c.query("network")
+	if err != nil {
+		return nil, err
+	}
+	data, ok := value.([]interface{})
+	if !ok {
+		return nil, c.error(c.url("vcenter/network"), 0, fmt.Errorf("expected a list of networks, got %T", value))
+	}
+	networks := make(map[string]string, len(data))
+	for _, value := range data {
+		entry, _ := value.(map[string]interface{})
+		id, _ := entry["network"].(string)
+		networks[id], _ = entry["name"].(string)
+	}
+	return networks, nil
 }
@@ -0,0 +1,413 @@
+package csvhost
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testVCenter is a fake vCenter REST API. Responses are the value of each
+// request, keyed by method, path and unescaped query, e.g.
+// "GET /rest/vcenter/vm?filter.names.1=web01".
+type testVCenter struct {
+	*httptest.Server
+	responses map[string]interface{}
+
+	mu       sync.Mutex
+	session  string // the session vCenter accepts, "" once it has expired
+	logins   int
+	logouts  int
+	requests []string
+}
+
+// newTestVCenter starts a fake vCenter, which the caller must Close, and
+// returns it with a client for it.
+func newTestVCenter(responses map[string]interface{}) (*testVCenter, *Client) {
+	v := &testVCenter{responses: responses}
+	v.Server = httptest.NewTLSServer(http.HandlerFunc(v.serve))
+
+	client := &Client{
+		server:    strings.TrimPrefix(v.URL, "https://"),
+		user:      "admin",
+		password:  "secret",
+		tlsConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	return v, client
+}
+
+func (v *testVCenter) serve(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key := r.Method + " " + r.URL.Path
+	if query, _ := url.QueryUnescape(r.URL.Query().Encode()); query != "" {
+		key += "?" + query
+	}
+	v.requests = append(v.requests, key)
+
+	if r.URL.Path == "/rest/com/vmware/cis/session" && r.Method == http.MethodPost {
+		if user, password, _ := r.BasicAuth(); user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		v.logins++
+		v.session = fmt.Sprintf("session-%d", v.logins)
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": v.session})
+		return
+	}
+
+	cookie, err := r.Cookie("vmware-api-session-id")
+	if err != nil || v.session == "" || cookie.Value != v.session {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.URL.Path == "/rest/com/vmware/cis/session" && r.Method == http.MethodDelete {
+		v.logouts++
+		v.session = ""
+		return
+	}
+
+	value, ok := v.responses[key]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if status, ok := value.(testStatus); ok {
+		w.WriteHeader(int(status))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+}
+
+// testStatus is a response of only an HTTP status.
+type testStatus int
+
+// expire ends the current session as if it had timed out.
+func (v *testVCenter) expire() {
+	v.mu.Lock()
+	v.session = ""
+	v.mu.Unlock()
+}
+
+var testSessionResponses = map[string]interface{}{
+	"GET /rest/vcenter/vm?filter.names.1=web01": []interface{}{
+		map[string]interface{}{"vm": "vm-1", "name": "web01"},
+	},
+}
+
+func TestClient_reauthenticate(t *testing.T) {
+	vcenter, client := newTestVCenter(testSessionResponses)
+	defer vcenter.Close()
+
+	for i := 0; i < 2; i++ {
+		if vmid, err := client.getVm("web01"); err != nil || vmid != "vm-1" {
+			t.Fatalf("got %q, %v", vmid, err)
+		}
+	}
+	if vcenter.logins != 1 {
+		t.Fatalf("expected the session to be reused, logged in %d times", vcenter.logins)
+	}
+
+	// an expired session is replaced and the request retried
+	vcenter.expire()
+	if vmid, err := client.getVm("web01"); err != nil || vmid != "vm-1" {
+		t.Fatalf("got %q, %v", vmid, err)
+	}
+	if vcenter.logins != 2 {
+		t.Fatalf("expected 2 logins, got %d", vcenter.logins)
+	}
+
+	// bad credentials aren't retried forever
+	client.password = "wrong"
+	vcenter.expire()
+	_, err := client.getVm("web01")
+	if err == nil || !strings.Contains(err.Error(), "401") || !strings.Contains(err.Error(), "check the provider's user and password") {
+		t.Fatalf("expected a 401 error with advice, got %v", err)
+	}
+}
+
+func TestClient_serverError(t *testing.T) {
+	vcenter, client := newTestVCenter(map[string]interface{}{
+		"GET /rest/vcenter/vm?filter.names.1=web01": testStatus(http.StatusServiceUnavailable),
+	})
+	defer vcenter.Close()
+
+	_, err := client.getVm("web01")
+	if !isServerError(err) || !strings.Contains(err.Error(), "try again once it is healthy") {
+		t.Fatalf("expected a server error with advice, got %v", err)
+	}
+}
+
+func TestClient_reconnectOnce(t *testing.T) {
+	vcenter, client := newTestVCenter(testSessionResponses)
+	defer vcenter.Close()
+
+	stale, err := client.connect()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	vcenter.expire()
+
+	// every request that saw the expired session gets the one new session
+	var wg sync.WaitGroup
+	errors := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := client.reconnect(stale); err != nil {
+				errors <- err
+			}
+			if _, err := client.getVm("web01"); err != nil {
+				errors <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errors)
+	for err := range errors {
+		t.Fatalf("err: %s", err)
+	}
+	if vcenter.logins != 2 {
+		t.Fatalf("expected 2 logins, got %d", vcenter.logins)
+	}
+}
+
+func TestClient_release(t *testing.T) {
+	vcenter, client := newTestVCenter(testSessionResponses)
+	defer vcenter.Close()
+
+	// the session lasts until the last read using it finishes
+	client.acquire()
+	client.acquire()
+	if _, err := client.getVm("web01"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	client.release()
+	if vcenter.logouts != 0 {
+		t.Fatal("logged out while a read was still using the session")
+	}
+	client.release()
+	if vcenter.logouts != 1 || client.connection != nil {
+		t.Fatalf("expected 1 logout, got %d", vcenter.logouts)
+	}
+
+	// a later read starts a new session
+	client.acquire()
+	if _, err := client.getVm("web01"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	client.release()
+	if vcenter.logins != 2 || vcenter.logouts != 2 {
+		t.Fatalf("expected 2 logins and logouts, got %d and %d", vcenter.logins, vcenter.logouts)
+	}
+}
+
+func TestClient_stop(t *testing.T) {
+	vcenter, client := newTestVCenter(testSessionResponses)
+	defer vcenter.Close()
+
+	client.acquire()
+	if _, err := client.getVm("web01"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := client.stop(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if vcenter.logouts != 1 {
+		t.Fatalf("expected 1 logout, got %d", vcenter.logouts)
+	}
+
+	// a read still in flight fails rather than starting a session that
+	// would never be ended
+	if _, err := client.getVm("web01"); err == nil {
+		t.Fatal("expected an error after stopping")
+	}
+	client.release()
+	if vcenter.logins != 1 {
+		t.Fatalf("logged in again after stopping")
+	}
+}
+
+func TestClient_malformedResponses(t *testing.T) {
+	vcenter, client := newTestVCenter(map[string]interface{}{
+		"GET /rest/vcenter/vm?filter.names.1=null":      nil,
+		"GET /rest/vcenter/vm?filter.names.1=web01":     []interface{}{nil},
+		"GET /rest/vcenter/vm?filter.names.1=web02":     []interface{}{"vm-2"},
+		"GET /rest/vcenter/vm?filter.clusters.1=c1":     []interface{}{nil, float64(5), map[string]interface{}{"name": "web03"}},
+		"GET /rest/vcenter/vm/vm-1":                     nil,
+		"GET /rest/com/vmware/cis/tagging/tag":          []interface{}{"tag-1"},
+		"GET /rest/com/vmware/cis/tagging/tag/id:tag-1": nil,
+	})
+	defer vcenter.Close()
+
+	for _, name := range []string{"null", "web01", "web02"} {
+		if _, err := client.getVm(name); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := client.getVmDetails("vm-1"); err == nil {
+		t.Error("expected an error for null VM details")
+	}
+	vms, err := client.getVmList(url.Values{"filter.clusters.1": {"c1"}})
+	if err != nil || len(vms) != 3 || vms[2] != "web03" {
+		t.Errorf("got %v, %v", vms, err)
+	}
+	if _, err := client.getTaggedDatastores([]string{"gold"}); err == nil {
+		t.Error("expected an error for a tag without a name")
+	}
+
+	details := map[string]interface{}{
+		"disks":         []interface{}{nil},
+		"scsi_adapters": []interface{}{nil, "scsi0"},
+		"nics":          []interface{}{nil},
+	}
+	if _, err := getDisks(details); err == nil {
+		t.Error("expected an error for a null disk")
+	}
+	if names := vmNetworkNames(details, nil); len(names) != 0 {
+		t.Errorf("got networks %v", names)
+	}
+}
+
+func testDisk(label, vmdk string, bus, unit int) interface{} {
+	return map[string]interface{}{
+		"value": map[string]interface{}{
+			"label":   label,
+			"type":    "SCSI",
+			"scsi":    map[string]interface{}{"bus": float64(bus), "unit": float64(unit)},
+			"backing": map[string]interface{}{"vmdk_file": vmdk},
+		},
+	}
+}
+
+func TestGetDisks(t *testing.T) {
+	details := map[string]interface{}{
+		"disks": []interface{}{
+			testDisk("Hard disk 2", "[ds1] web01/web01_1.vmdk", 0, 1),
+			testDisk("Hard disk 1", "[ds1] web01/web01.vmdk", 0, 0),
+		},
+	}
+
+	disks, err := getDisks(details)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(disks) != 2 || disks[0].vmdk.String() != "[ds1] web01/web01.vmdk" || disks[1].vmdk.String() != "[ds1] web01/web01_1.vmdk" {
+		t.Fatalf("unexpected disks: %v", disks)
+	}
+}
+
+func TestGetDisks_order(t *testing.T) {
+	// localised and renamed labels, and gaps in the numbering, don't matter
+	details := map[string]interface{}{
+		"disks": []interface{}{
+			testDisk("Festplatte 3", "[ds1] web01/web01_2.vmdk", 1, 0),
+			testDisk("data", "[ds1] web01/web01_1.vmdk", 0, 8),
+			testDisk("Festplatte 1", "[ds1] web01/web01.vmdk", 0, 0),
+			map[string]interface{}{
+				"value": map[string]interface{}{
+					"label":   "Hard disk 9",
+					"type":    "SATA",
+					"sata":    map[string]interface{}{"bus": float64(0), "unit": float64(0)},
+					"backing": map[string]interface{}{"vmdk_file": "[ds1] web01/web01_3.vmdk"},
+				},
+			},
+		},
+	}
+
+	disks, err := getDisks(details)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []string{"web01", "web01_1", "web01_2", "web01_3"}
+	for i := range want {
+		if disks[i].vmdk.base() != want[i] {
+			t.Fatalf("disk %d: got %s; want %s", i, disks[i].vmdk.base(), want[i])
+		}
+	}
+	if disks[3].label != "Hard disk 9" || disks[3].controller() != "sata0" {
+		t.Fatalf("unexpected disk: %+v", disks[3])
+	}
+}
+
+func TestGetDisks_badPath(t *testing.T) {
+	details := map[string]interface{}{
+		"disks": []interface{}{
+			testDisk("Hard disk 1", "web01/web01.vmdk", 0, 0),
+		},
+	}
+
+	_, err := getDisks(details)
+	if _, ok := err.(*DiskError); !ok {
+		t.Fatalf("expected a DiskError, got %#v", err)
+	}
+}
+
+func TestGetDisks_address(t *testing.T) {
+	details := map[string]interface{}{
+		"disks": []interface{}{
+			map[string]interface{}{
+				"value": map[string]interface{}{
+					"label":    "Hard disk 1",
+					"type":     "SCSI",
+					"scsi":     map[string]interface{}{"bus": float64(1), "unit": float64(3)},
+					"capacity": float64(40 << 30),
+					"backing":  map[string]interface{}{"vmdk_file": "[ds1] web01/web01.vmdk"},
+				},
+			},
+			map[string]interface{}{
+				"value": map[string]interface{}{
+					"label":   "Hard disk 2",
+					"type":    "IDE",
+					"ide":     map[string]interface{}{"primary": false, "master": true},
+					"backing": map[string]interface{}{"vmdk_file": "[ds1] web01/web01_1.vmdk"},
+				},
+			},
+		},
+		"scsi_adapters": []interface{}{
+			map[string]interface{}{
+				"key":   "1000",
+				"value": map[string]interface{}{"type": "LSILOGIC", "scsi": map[string]interface{}{"bus": float64(0), "unit": float64(7)}},
+			},
+			map[string]interface{}{
+				"key":   "1001",
+				"value": map[string]interface{}{"type": "PVSCSI", "scsi": map[string]interface{}{"bus": float64(1), "unit": float64(7)}},
+			},
+		},
+	}
+
+	disks, err := getDisks(details)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []vmDisk{
+		{label: "Hard disk 1", vmdk: datastorePath{"ds1", "web01/web01.vmdk"}, capacity: 40 << 30, bus: "scsi", number: 1, unit: 3, controllerType: "pvscsi"},
+		{label: "Hard disk 2", vmdk: datastorePath{"ds1", "web01/web01_1.vmdk"}, bus: "ide", number: 1, unit: 0, controllerType: "ide"},
+	}
+	for i := range want {
+		if disks[i] != want[i] {
+			t.Errorf("disk %d: got %+v; want %+v", i, disks[i], want[i])
+		}
+	}
+}
+
+func TestGetVmSummary(t *testing.T) {
+	details := map[string]interface{}{
+		"cpu":         map[string]interface{}{"count": float64(4), "cores_per_socket": float64(2)},
+		"memory":      map[string]interface{}{"size_MiB": float64(8192)},
+		"power_state": "POWERED_ON",
+		"guest_OS":    "RHEL_7_64",
+	}
+
+	want := vmSummary{cpu: 4, memory: 8192, power: "poweredOn", guestOS: "RHEL_7_64"}
+	if got := getVmSummary(details); got != want {
+		t.Fatalf("got %+v; want %+v", got, want)
+	}
+}
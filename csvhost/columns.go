@@ -0,0 +1,176 @@
+package csvhost
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// knownColumns are the columns the data source understands.
+var knownColumns = []string{"hostname", "address", "gateway", "subnet", "cpu", "memory", "vapp", "network", "template", "expires", "disk_count"}
+
+// requiredColumns must be present in every inventory. A missing expires
+// column is treated as every row being blank, and a missing disk_count
+// column as every row planning the default number of disks.
+var requiredColumns = []string{"hostname", "address", "gateway", "subnet", "cpu", "memory", "vapp", "network", "template"}
+
+// column describes the type of a known CSV column and how its values are
+// validated. Values are validated as the raw strings from the file; the
+// whole row is passed so that columns can depend on each other. A blank
+// integer that passes validation is left out of the row.
+type column struct {
+	integer  bool
+	validate func(value string, row map[string]string) error
+}
+
+var columnSchema = map[string]column{
+	"hostname":   column{validate: validateHostname},
+	"address":    column{validate: validateAddress},
+	"gateway":    column{validate: validateGateway},
+	"subnet":     column{integer: true, validate: validateSubnet},
+	"cpu":        column{integer: true, validate: validatePositive},
+	"memory":     column{integer: true, validate: validatePositive},
+	"vapp":       column{},
+	"network":    column{},
+	"template":   column{},
+	"expires":    column{},
+	"disk_count": column{integer: true, validate: validateDiskCount},
+}
+
+var hostnameLabel = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateHostname accepts a host name made of RFC 1123 labels.
+func validateHostname(value string, row map[string]string) error {
+	if value == "" {
+		return fmt.Errorf("must not be empty")
+	}
+	if len(value) > 253 {
+		return fmt.Errorf("%q is longer than 253 characters", value)
+	}
+	for _, label := range strings.Split(value, ".") {
+		if !hostnameLabel.MatchString(label) {
+			return fmt.Errorf("%q is not a valid RFC 1123 host name", value)
+		}
+	}
+	return nil
+}
+
+func validateAddress(value string, row map[string]string) error {
+	if net.ParseIP(value) == nil {
+		return fmt.Errorf("%q is not an IPv4 or IPv6 address", value)
+	}
+	return nil
+}
+
+// validateGateway accepts a blank gateway for hosts without a default route.
+func validateGateway(value string, row map[string]string) error {
+	if value == "" {
+		return nil
+	}
+	return validateAddress(value, row)
+}
+
+// validateSubnet checks the prefix length against the family of the address
+// column.
+func validateSubnet(value string, row map[string]string) error {
+	prefix, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not a prefix length", value)
+	}
+	max := 32
+	if ip := net.ParseIP(row["address"]); ip != nil && ip.To4() == nil {
+		max = 128
+	}
+	if prefix < 0 || prefix > max {
+		return fmt.Errorf("prefix length %d is out of range 0-%d", prefix, max)
+	}
+	return nil
+}
+
+func validatePositive(value string, row map[string]string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("%q is not an integer", value)
+	}
+	if n < 1 {
+		return fmt.Errorf("%d must be positive", n)
+	}
+	return nil
+}
+
+// validateDiskCount accepts a blank disk count for the default.
+func validateDiskCount(value string, row map[string]string) error {
+	if value == "" {
+		return nil
+	}
+	return validatePositive(value, row)
+}
+
+// convertRow validates the known columns of a row and converts them to
+// their declared types. Every problem in the row is returned.
+func convertRow(raw map[string]string) (map[string]interface{}, []error) {
+	errors := make([]error, 0)
+	row := make(map[string]interface{}, len(raw))
+	for _, name := range knownColumns {
+		value, ok := raw[name]
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		c := columnSchema[name]
+		if c.validate != nil {
+			if err := c.validate(value, raw); err != nil {
+				errors = append(errors, fmt.Errorf("column %q: %s", name, err))
+				continue
+			}
+		}
+		if c.integer && value == "" {
+			continue
+		} else if c.integer {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				errors = append(errors, fmt.Errorf("column %q: %q is not an integer", name, value))
+				continue
+			}
+			row[name] = n
+		} else {
+			row[name] = value
+		}
+	}
+	return row, errors
+}
+
+func isKnownColumn(name string) bool {
+	for _, c := range knownColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkColumns returns an error naming every required column missing from
+// columns, or any column named more than once.
+func checkColumns(columns []string) error {
+	seen := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		if seen[c] && c != "" {
+			return fmt.Errorf("column %q appears more than once", c)
+		}
+		seen[c] = true
+	}
+
+	missing := make([]string, 0)
+	for _, c := range requiredColumns {
+		if !seen[c] {
+			missing = append(missing, c)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
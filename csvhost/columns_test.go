@@ -0,0 +1,74 @@
+package csvhost
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConvertRow(t *testing.T) {
+	raw := map[string]string{
+		"hostname":   "0123",
+		"address":    "2001:db8::10",
+		"gateway":    "",
+		"subnet":     "64",
+		"cpu":        "2",
+		"memory":     "4096",
+		"vapp":       "web",
+		"expires":    "",
+		"disk_count": "",
+	}
+
+	row, errors := convertRow(raw)
+	if len(errors) != 0 {
+		t.Fatalf("unexpected errors: %v", errors)
+	}
+	if _, ok := row["disk_count"]; ok {
+		t.Fatalf("blank disk_count converted to %#v", row["disk_count"])
+	}
+	if row["hostname"] != "0123" {
+		t.Fatalf("hostname converted to %#v", row["hostname"])
+	}
+	if row["subnet"] != 64 || row["cpu"] != 2 || row["memory"] != 4096 {
+		t.Fatalf("integer columns not converted: %v", row)
+	}
+
+	raw["disk_count"] = "3"
+	if row, _ := convertRow(raw); row["disk_count"] != 3 {
+		t.Fatalf("disk_count converted to %#v", row["disk_count"])
+	}
+}
+
+func TestConvertRow_invalid(t *testing.T) {
+	raw := map[string]string{
+		"hostname":   "web_01",
+		"address":    "10.0.0.300",
+		"gateway":    "10.0.0.1",
+		"subnet":     "33",
+		"cpu":        "0",
+		"memory":     "lots",
+		"disk_count": "0",
+	}
+
+	_, errors := convertRow(raw)
+	if len(errors) != 6 {
+		t.Fatalf("expected 6 errors, got %d: %v", len(errors), errors)
+	}
+}
+
+func TestReadCSV_invalidRows(t *testing.T) {
+	data := []byte(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small
+-web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small
+web03,10.0.0.12,10.0.0.1,24,two,4096,web,vlan10,small
+`)
+
+	_, _, _, err := readRows(&csvReader{comma: ','}, data, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, want := range []string{`line 3 (-web02): column "hostname"`, `line 4 (web03): column "cpu"`} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error doesn't contain %q: %s", want, err)
+		}
+	}
+}
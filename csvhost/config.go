@@ -0,0 +1,59 @@
+package csvhost
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// Config holds the provider level settings used to reach vCenter.
+type Config struct {
+	Server             string
+	User               string
+	Password           string
+	AllowUnverifiedSSL bool
+	CAFile             string
+}
+
+// Client validates the configuration and returns a client that can be handed
+// to data sources as their meta value.
+func (c *Config) Client() (*Client, error) {
+	if c.Server == "" {
+		return nil, fmt.Errorf("vsphere_server must be provided")
+	}
+
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		server:    c.Server,
+		user:      c.User,
+		password:  c.Password,
+		tlsConfig: tlsConfig,
+		now:       time.Now,
+	}
+	return client, nil
+}
+
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.AllowUnverifiedSSL}
+	if c.CAFile == "" {
+		return tlsConfig, nil
+	}
+
+	pem, err := ioutil.ReadFile(c.CAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ca_file %q: %s", c.CAFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("ca_file %q contains no PEM encoded certificates", c.CAFile)
+	}
+	tlsConfig.RootCAs = pool
+	return tlsConfig, nil
+}
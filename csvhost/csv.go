@@ -0,0 +1,146 @@
+package csvhost
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// csvReader reads delimited text such as CSV and TSV.
+type csvReader struct {
+	comma            rune
+	comment          rune
+	lazyQuotes       bool
+	trimLeadingSpace bool
+	skipRows         int
+}
+
+func (r *csvReader) read(data []byte, columns []string) ([]string, []rawRow, error) {
+	// skipped rows are cut off before parsing so that quotes in them can't
+	// run on into the data
+	text := string(data)
+	for i := 0; i < r.skipRows && text != ""; i++ {
+		if end := strings.Index(text, "\n"); end >= 0 {
+			text = text[end+1:]
+		} else {
+			text = ""
+		}
+	}
+
+	lines := &lineReader{text: text}
+	reader := csv.NewReader(lines)
+	reader.Comma = r.comma
+	reader.Comment = r.comment
+	reader.LazyQuotes = r.lazyQuotes
+	reader.TrimLeadingSpace = r.trimLeadingSpace
+	reader.FieldsPerRecord = -1 // readTable reports the line of short rows
+
+	records := make([]tableRecord, 0)
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if e, ok := err.(*csv.ParseError); ok {
+				return nil, nil, fmt.Errorf("line %d: %s", e.Line+r.skipRows, e.Err)
+			}
+			return nil, nil, err
+		}
+		if len(record) == 1 && strings.TrimSpace(record[0]) == "" {
+			// lines of nothing but spaces
+			continue
+		}
+		// the record ends on the last line handed to the reader and
+		// starts as many lines before as its fields have newlines
+		line := lines.read
+		for _, field := range record {
+			line -= strings.Count(field, "\n")
+		}
+		records = append(records, tableRecord{line: line + r.skipRows, fields: record})
+	}
+	return readTable(records, columns)
+}
+
+// lineReader hands text to a csv.Reader no more than a line at a time, so
+// that the reader's buffer never runs ahead of the record it returns and
+// the lines handed over give the line number of the record.
+type lineReader struct {
+	text string
+	read int // lines handed over, including a final line without "\n"
+}
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	if r.text == "" {
+		return 0, io.EOF
+	}
+	n := len(r.text)
+	if end := strings.Index(r.text, "\n"); end >= 0 && end+1 < n {
+		n = end + 1
+	}
+	n = copy(p, r.text[:n])
+	if strings.HasSuffix(r.text[:n], "\n") || n == len(r.text) {
+		r.read++
+	}
+	r.text = r.text[n:]
+	return n, nil
+}
+
+// tableRecord is a row of a tabular source along with its line number.
+type tableRecord struct {
+	line   int
+	fields []string
+}
+
+// readTable turns the records of a tabular source into rows.
+//
+// The first record is the header naming the columns. When columns is not
+// empty it is used instead, and the first record is only skipped if it
+// matches it.
+func readTable(records []tableRecord, columns []string) ([]string, []rawRow, error) {
+	if len(records) == 0 {
+		return columns, nil, nil
+	}
+
+	if len(columns) == 0 {
+		columns = normaliseHeader(records[0].fields)
+		records = records[1:]
+	} else if sameColumns(columns, normaliseHeader(records[0].fields)) {
+		// skip the header row if provided
+		records = records[1:]
+	}
+
+	rows := make([]rawRow, 0, len(records))
+	for _, record := range records {
+		if len(record.fields) != len(columns) {
+			return nil, nil, fmt.Errorf("line %d: expected %d fields, found %d", record.line, len(columns), len(record.fields))
+		}
+		values := make(map[string]string, len(columns))
+		for i, k := range columns {
+			values[k] = record.fields[i]
+		}
+		rows = append(rows, rawRow{where: fmt.Sprintf("line %d", record.line), values: values})
+	}
+	return columns, rows, nil
+}
+
+func normaliseHeader(record []string) []string {
+	columns := make([]string, len(record))
+	for i, v := range record {
+		columns[i] = strings.ToLower(strings.TrimSpace(v))
+	}
+	return columns
+}
+
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
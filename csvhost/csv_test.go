@@ -0,0 +1,180 @@
+package csvhost
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadCSV_header(t *testing.T) {
+	data := []byte(`template,hostname,address,gateway,subnet,cpu,memory,vapp,network,expires
+small,web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,2030-01-01
+`)
+
+	_, rows, _, err := readRows(&csvReader{comma: ','}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %d", len(rows))
+	}
+	if rows[0]["hostname"] != "web01" || rows[0]["template"] != "small" || rows[0]["cpu"] != 2 {
+		t.Fatalf("columns mapped wrongly: %v", rows[0])
+	}
+}
+
+func TestReadCSV_columns(t *testing.T) {
+	columns := []string{"hostname", "address", "gateway", "subnet", "cpu", "memory", "vapp", "network", "template", "expires"}
+	data := []byte(`web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small,
+`)
+
+	_, rows, _, err := readRows(&csvReader{comma: ','}, data, columns)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 1 || rows[0]["hostname"] != "web01" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+func TestReadCSV_missingColumns(t *testing.T) {
+	data := []byte(`hostname,address,gateway,subnet,memory,vapp,network
+web01,10.0.0.10,10.0.0.1,24,4096,web,vlan10
+`)
+
+	_, _, _, err := readRows(&csvReader{comma: ','}, data, nil)
+	if err == nil {
+		t.Fatal("expected an error for missing columns")
+	}
+	if !strings.Contains(err.Error(), "cpu, template") {
+		t.Fatalf("error doesn't name the missing columns: %s", err)
+	}
+}
+
+func TestReadCSV_extra(t *testing.T) {
+	data := []byte(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template,owner,Backup Tier
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small,ops,gold
+`)
+
+	_, rows, _, err := readRows(&csvReader{comma: ','}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	extra := rows[0]["extra"].(map[string]interface{})
+	if len(extra) != 2 || extra["owner"] != "ops" || extra["backup tier"] != "gold" {
+		t.Fatalf("unexpected extra columns: %v", extra)
+	}
+	if _, ok := rows[0]["owner"]; ok {
+		t.Fatal("extra column leaked into the known columns")
+	}
+}
+
+func TestReadCSV_dialect(t *testing.T) {
+	data := []byte(`Exported from the inventory spreadsheet
+hostname;address;gateway;subnet;cpu;memory;vapp;network;template;notes
+# decommissioned
+# db01;10.0.0.20;10.0.0.1;24;4;8192;db;vlan10;large;
+web01; 10.0.0.10; 10.0.0.1; 24; 2; 4096; web; vlan10; small; "first line
+second line"
+web02; 10.0.0.11; 10.0.0.1; 24; 2; 4096; web; vlan10; small; ""
+
+web03; 10.0.0.12; 10.0.0.1; 24; none; 4096; web; vlan10; small; ""
+`)
+
+	reader := &csvReader{comma: ';', comment: '#', trimLeadingSpace: true, skipRows: 1}
+	_, _, _, err := readRows(reader, data, nil)
+	if err == nil || !strings.Contains(err.Error(), `line 9 (web03): column "cpu"`) {
+		t.Fatalf("expected an error on line 9, got %v", err)
+	}
+
+	data = []byte(strings.Replace(string(data), "none", "2", 1))
+	_, rows, _, err := readRows(reader, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 3 || rows[0]["address"] != "10.0.0.10" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+	if notes := rows[0]["extra"].(map[string]interface{})["notes"]; notes != "first line\nsecond line" {
+		t.Fatalf("multi-line field read as %q", notes)
+	}
+}
+
+func TestReadCSV_parseErrorLine(t *testing.T) {
+	data := []byte(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,sm"all
+`)
+
+	_, _, _, err := readRows(&csvReader{comma: ','}, data, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Fatalf("expected an error on line 2, got %v", err)
+	}
+}
+
+func TestReadCSV_quoteInComment(t *testing.T) {
+	data := []byte(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+# 19" rack hosts
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small
+web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small
+`)
+
+	_, rows, where, err := readRows(&csvReader{comma: ',', comment: '#'}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 2 || where[1] != "line 4" {
+		t.Fatalf("unexpected rows: %v at %v", rows, where)
+	}
+}
+
+func TestReadCSV_quoteInSkippedRow(t *testing.T) {
+	data := []byte(`Exported from "inventory
+hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small
+`)
+
+	_, rows, where, err := readRows(&csvReader{comma: ',', skipRows: 1}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 1 || where[0] != "line 3" {
+		t.Fatalf("unexpected rows: %v at %v", rows, where)
+	}
+}
+
+func TestReadCSV_lazyQuotes(t *testing.T) {
+	for _, reader := range []*csvReader{{comma: ',', lazyQuotes: true}, {comma: '\t', lazyQuotes: true}} {
+		data := []byte(strings.Replace(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template,notes
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small,5" rack
+web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small,
+web03,10.0.0.12,10.0.0.1,24,2,4096,web,vlan10,small,
+`, ",", string(reader.comma), -1))
+
+		_, rows, where, err := readRows(reader, data, nil)
+		if err != nil {
+			t.Fatalf("%q: err: %s", reader.comma, err)
+		}
+		if len(rows) != 3 || where[2] != "line 4" {
+			t.Fatalf("%q: unexpected rows: %v at %v", reader.comma, rows, where)
+		}
+		if notes := rows[0]["extra"].(map[string]interface{})["notes"]; notes != `5" rack` {
+			t.Fatalf("%q: notes read as %q", reader.comma, notes)
+		}
+	}
+}
+
+func TestReadCSV_lineNumbers(t *testing.T) {
+	data := []byte(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template,notes
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small,"` + strings.Repeat("x", 10000) + `
+and more"
+
+web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small,` + strings.Repeat("y", 10000) + `
+web03,10.0.0.12,10.0.0.1,24,2,4096,web,vlan10,small,"last"`)
+
+	_, _, where, err := readRows(&csvReader{comma: ','}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []string{"line 2", "line 5", "line 6"}; strings.Join(where, ", ") != strings.Join(want, ", ") {
+		t.Fatalf("got %v; want %v", where, want)
+	}
+}
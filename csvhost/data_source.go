@@ -1,36 +1,101 @@
 package csvhost
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"github.com/hashicorp/terraform/helper/schema"
-	"io"
-	"io/ioutil"
 	"log"
-	"strconv"
+	"sort"
 	"strings"
-	"time"
 )
 
 var MAX_DISKS = 4
 
-func check(e error) {
-	if e != nil {
-		panic(e)
-	}
-}
-
 func dataSource() *schema.Resource {
 	return &schema.Resource{
 		Read: dataSourceRead,
 
 		Schema: map[string]*schema.Schema{
+			// csvfile is a local path or a go-getter URL, e.g.
+			// "https://...", "s3::https://..." or
+			// "git::https://.../inventory.git//hosts.csv?ref=v1"
 			"csvfile": &schema.Schema{
 				Type:     schema.TypeString,
 				Required: true,
 			},
 
+			"checksum": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateChecksum,
+			},
+
+			// cache_dir keeps the last good copy of a remote csvfile.
+			// Remote sources are downloaded again on every read and the
+			// cache is never read first; a copy is only used when the
+			// download fails, and only if it is younger than
+			// cache_max_age. Without cache_max_age a failed download is an
+			// error.
+			"cache_dir": &schema.Schema{
+				Type:     schema.TypeString,
+				Optional: true,
+			},
+
+			"cache_max_age": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validatePeriod,
+			},
+
+			// format is one of csv, tsv, json, yaml or xlsx. When it isn't
+			// set the extension of csvfile is used.
+			"format": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateFormat,
+			},
+
+			"delimiter": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateSingleCharacter,
+			},
+
+			"comment": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateSingleCharacter,
+			},
+
+			"lazy_quotes": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			"trim_leading_space": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+			},
+
+			"skip_rows": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validateNonNegative,
+			},
+
+			"encoding": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "utf-8",
+				ValidateFunc: validateEncoding,
+			},
+
+			"detect_bom": &schema.Schema{
+				Type:     schema.TypeBool,
+				Optional: true,
+				Default:  true,
+			},
+
 			"query": &schema.Schema{
 				Type:     schema.TypeMap,
 				Optional: true,
@@ -39,9 +104,191 @@ func dataSource() *schema.Resource {
 				},
 			},
 
+			"filter": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateFilter,
+			},
+
+			"columns": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+
+			// sort_by names the columns to order results by; prefix a column
+			// with "-" to sort it in descending order.
+			"sort_by": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+
+			"offset": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validateNonNegative,
+			},
+
+			"limit": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				ValidateFunc: validateNonNegative,
+			},
+
+			// expiry sets when hosts past their expires date are powered
+			// off and dropped, and how far ahead they are listed in
+			// expiring_soon. Periods are written like "1y", "2w", "7d" or
+			// "36h", and can be overridden per row by lifetime,
+			// grace_period, expired_power_state, drop_after and
+			// notice_period columns.
+			"expiry": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"default_lifetime": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "1y",
+							ValidateFunc: validatePeriod,
+						},
+						"grace_period": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "0",
+							ValidateFunc: validatePeriod,
+						},
+						"expired_power_state": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "poweredOff",
+							ValidateFunc: validatePowerState,
+						},
+						"drop_after": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "7d",
+							ValidateFunc: validatePeriod,
+						},
+						"notice_period": &schema.Schema{
+							Type:         schema.TypeString,
+							Optional:     true,
+							Default:      "14d",
+							ValidateFunc: validatePeriod,
+						},
+					},
+				},
+			},
+
+			// expires_formats are tried in order when parsing the expires
+			// column: Go time layouts such as "2006-01-02" or
+			// "01/02/2006", "rfc3339" for timestamps and "excel" for
+			// spreadsheet serial day numbers.
+			"expires_formats": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type:         schema.TypeString,
+					ValidateFunc: validateExpiresFormat,
+				},
+			},
+
+			// timezone is an IANA name such as "Europe/London" used for
+			// expires dates without a zone and for deciding what day it
+			// is. The local timezone is used when it isn't set.
+			"timezone": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateTimezone,
+			},
+
+			// as_of works out expiry for the given "YYYY-MM-DD" date rather
+			// than today, e.g. to preview which hosts will be powered off
+			// next week.
+			"as_of": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				ValidateFunc: validateDate,
+			},
+
+			// clusterPrefix limits new disks to datastores whose names
+			// start with it.
 			"clusterPrefix": &schema.Schema{
 				Type:     schema.TypeString,
-				Required: true,
+				Optional: true,
+			},
+
+			// datastore_filter limits new disks to matching datastores.
+			// All the given tags must be attached; a tag may be written
+			// "category/name", and must be when its name is used in more
+			// than one category. vCenter's REST API doesn't relate
+			// datastores to the compute clusters that mount them, nor list
+			// datastore clusters (storage pods) or their members, so
+			// cluster and datastore_cluster are refused with a pointer to
+			// tags, which can stand in for either.
+			"datastore_filter": &schema.Schema{
+				Type:     schema.TypeList,
+				Optional: true,
+				MaxItems: 1,
+				Elem: &schema.Resource{
+					Schema: map[string]*schema.Schema{
+						"datacenter": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+						},
+						"cluster": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Removed:  "vCenter's REST API doesn't say which datastores a compute cluster mounts; tag the cluster's datastores and use tags instead",
+						},
+						"datastore_cluster": &schema.Schema{
+							Type:     schema.TypeString,
+							Optional: true,
+							Removed:  "vCenter's REST API doesn't list datastore clusters or their members; tag the datastore cluster's datastores and use tags instead",
+						},
+						"types": &schema.Schema{
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type:         schema.TypeString,
+								ValidateFunc: validateDatastoreType,
+							},
+						},
+						"min_free_space_gb": &schema.Schema{
+							Type:         schema.TypeInt,
+							Optional:     true,
+							ValidateFunc: validateNonNegative,
+						},
+						"tags": &schema.Schema{
+							Type:     schema.TypeList,
+							Optional: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+					},
+				},
+			},
+
+			// placement picks the datastore for hosts without a VM from
+			// those allowed by clusterPrefix and datastore_filter: hash
+			// (of the hostname), most_free_space, round_robin, random or
+			// column, which uses the datastore named in a "lun" column.
+			// hash, the default, keeps a host on the same datastore across
+			// plans until the datastores change. round_robin goes by the
+			// host's position among the selected rows after sort_by, so
+			// offset and limit don't change it.
+			"placement": &schema.Schema{
+				Type:         schema.TypeString,
+				Optional:     true,
+				Default:      "hash",
+				ValidateFunc: validatePlacement,
 			},
 
 			"result": &schema.Schema{
@@ -89,10 +336,117 @@ func dataSource() *schema.Resource {
 							Type:     schema.TypeString,
 							Computed: true,
 						},
+						// disk_count is the number of disks planned for a
+						// new host, or 0 when the row leaves it blank for
+						// the default of MAX_DISKS+1.
+						"disk_count": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
 						"power": &schema.Schema{
 							Type:     schema.TypeString,
 							Computed: true,
 						},
+						"expired": &schema.Schema{
+							Type:     schema.TypeBool,
+							Computed: true,
+						},
+						// days_until_expiry is negative once expires has passed
+						"days_until_expiry": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"drop_date": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"extra": &schema.Schema{
+							Type:     schema.TypeMap,
+							Computed: true,
+							Elem: &schema.Schema{
+								Type: schema.TypeString,
+							},
+						},
+						// disks lists every disk of an existing VM, ordered
+						// by controller and unit number, or the disks planned
+						// for a new one. Only name, datastore and path are
+						// known for new hosts. Thin or thick provisioning
+						// can't be read from the REST API.
+						"disks": &schema.Schema{
+							Type:     schema.TypeList,
+							Computed: true,
+							Elem: &schema.Resource{
+								Schema: map[string]*schema.Schema{
+									"index": &schema.Schema{
+										Type:     schema.TypeInt,
+										Computed: true,
+									},
+									"name": &schema.Schema{
+										Type:     schema.TypeString,
+										Computed: true,
+									},
+									"datastore": &schema.Schema{
+										Type:     schema.TypeString,
+										Computed: true,
+									},
+									"path": &schema.Schema{
+										Type:     schema.TypeString,
+										Computed: true,
+									},
+									"size_gb": &schema.Schema{
+										Type:     schema.TypeInt,
+										Computed: true,
+									},
+									"controller": &schema.Schema{
+										Type:     schema.TypeString,
+										Computed: true,
+									},
+									"unit_number": &schema.Schema{
+										Type:     schema.TypeInt,
+										Computed: true,
+									},
+									// label is the vCenter label, e.g. "Hard
+									// disk 1", which is localised and doesn't
+									// decide the order of disks.
+									"label": &schema.Schema{
+										Type:     schema.TypeString,
+										Computed: true,
+									},
+									// controller_type is the adapter model,
+									// e.g. "pvscsi", "lsilogic" or "ahci".
+									"controller_type": &schema.Schema{
+										Type:     schema.TypeString,
+										Computed: true,
+									},
+								},
+							},
+						},
+						// vm_id..vm_guest_os describe the existing VM, for
+						// comparison with cpu and memory, and are empty for
+						// new hosts. vm_memory is in MiB and vm_power_state
+						// uses the same names as power.
+						"vm_id": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"vm_cpu": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"vm_memory": &schema.Schema{
+							Type:     schema.TypeInt,
+							Computed: true,
+						},
+						"vm_power_state": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						"vm_guest_os": &schema.Schema{
+							Type:     schema.TypeString,
+							Computed: true,
+						},
+						// disk1..disk5 and their luns are the first disks, kept
+						// for configurations written before disks.
 						"disk1": &schema.Schema{
 							Type:     schema.TypeString,
 							Computed: true,
@@ -136,146 +490,402 @@ func dataSource() *schema.Resource {
 					},
 				},
 			},
+
+			// expired_hosts and expiring_soon list the hostnames of every
+			// selected row, before offset and limit are applied.
+			"expired_hosts": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
+
+			"expiring_soon": &schema.Schema{
+				Type:     schema.TypeList,
+				Computed: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+			},
 		},
 	}
 }
 
 func dataSourceRead(d *schema.ResourceData, meta interface{}) error {
+	datastores := datastoreFilterFromConfig(d.Get("clusterPrefix").(string), d.Get("datastore_filter").([]interface{}))
+	client := meta.(*Client)
+	client.acquire()
+	defer client.release()
+
+	placement, err := getPlacementStrategy(d.Get("placement").(string))
+	if err != nil {
+		return err
+	}
+
+	selected, err := selectRows(d, client)
+	if err != nil {
+		return err
+	}
+
+	sortBy := make([]string, 0)
+	for _, v := range d.Get("sort_by").([]interface{}) {
+		sortBy = append(sortBy, v.(string))
+	}
+	if err := sortRows(selected.rows, sortBy); err != nil {
+		return err
+	}
+	offset := d.Get("offset").(int)
+	filtered := pageRows(selected.rows, offset, d.Get("limit").(int))
+
+	// only the selected page is looked up in vCenter
+	for i, item := range filtered {
+		if err := enrichDisks(client, item, offset+i, datastores, placement); err != nil {
+			return err
+		}
+		log.Printf(
+			"============= (host %v for vapp %v - size %v) >>>>>>>>>>>>>>>>>\n",
+			item["hostname"],
+			item["vapp"],
+			item["template"])
+	}
+
+	log.Println("============= FILTERED >>>>>>>>>>>>>>>>>")
+	for i := range filtered {
+		log.Println(filtered[i])
+	}
+	log.Println("<<<<<<<<<<<<<=================")
+
+	d.Set("result", &filtered)
+	d.Set("expired_hosts", selected.expiredHosts)
+	d.Set("expiring_soon", selected.expiringSoon)
+	d.SetId("-")
+	return nil
+}
+
+// selection is the result of reading an inventory.
+type selection struct {
+	rows         []map[string]interface{} // selected by query, filter and expiry
+	expiredHosts []string                 // selected rows that have expired
+	expiringSoon []string                 // selected rows expiring soon
+	hostnames    map[string]bool          // every row in the inventory
+}
+
+// selectRows reads the inventory and returns the rows selected by query,
+// filter and expiry, in inventory order.
+func selectRows(d *schema.ResourceData, client *Client) (selection, error) {
+	var selected selection
 	csvfile := d.Get("csvfile").(string)
 	query := d.Get("query").(map[string]interface{})
-	clusterPrefix := d.Get("clusterPrefix").(string)
 
-	data, err := ioutil.ReadFile(csvfile)
-	reader := csv.NewReader(strings.NewReader(string(data)))
-	columns := []string{"hostname", "address", "gateway", "subnet", "cpu", "memory", "vapp", "network", "template", "expires"}
+	filter, err := parseFilter(d.Get("filter").(string))
+	if err != nil {
+		return selected, fmt.Errorf("Invalid filter: %s", err)
+	}
 
-	rows := make([]map[string]interface{}, 0)
-	for {
-		record, err := reader.Read()
-		if err == io.EOF {
-			break
-		}
+	columns := make([]string, 0)
+	for _, v := range d.Get("columns").([]interface{}) {
+		columns = append(columns, v.(string))
+	}
+
+	policy, err := expiryPolicyFromConfig(d.Get("expiry").([]interface{}))
+	if err != nil {
+		return selected, fmt.Errorf("Invalid expiry: %s", err)
+	}
+	parser, err := expiresParserFromConfig(d.Get("expires_formats").([]interface{}), d.Get("timezone").(string))
+	if err != nil {
+		return selected, err
+	}
+	today, err := parser.expiryDay(d.Get("as_of").(string), client.clock)
+	if err != nil {
+		return selected, err
+	}
+
+	cache, err := sourceCacheFromConfig(d.Get("cache_dir").(string), d.Get("cache_max_age").(string), client.clock())
+	if err != nil {
+		return selected, err
+	}
+	data, filename, err := fetchSource(csvfile, cache, d.Get("checksum").(string))
+	if err != nil {
+		return selected, fmt.Errorf("Failed to read CSV file %q: %s", csvfile, err)
+	}
+	reader, err := getSourceReader(d.Get("format").(string), filename)
+	if err != nil {
+		return selected, err
+	}
+	if err := applyDialect(reader, d); err != nil {
+		return selected, err
+	}
+	if _, ok := reader.(*xlsxReader); !ok {
+		data, err = decodeText(data, d.Get("encoding").(string), d.Get("detect_bom").(bool))
 		if err != nil {
-			return fmt.Errorf("Failed to read CSV file %q: %s", csvfile, err)
-		}
-		// skip the header row if provided
-		var header = true
-		for i, v := range record {
-			if v != columns[i] {
-				header = false
-			}
-		}
-		if header {
-			continue
-		}
-		row := make(map[string]interface{})
-		for i, k := range columns {
-			row[k], err = strconv.Atoi(record[i])
-			if err != nil {
-				row[k] = string(record[i])
-			}
-			log.Println(row)
+			return selected, fmt.Errorf("Failed to read CSV file %q: %s", csvfile, err)
 		}
-		rows = append(rows, row)
+	}
+	header, rows, where, err := readRows(reader, data, columns)
+	if err != nil {
+		return selected, fmt.Errorf("Failed to read CSV file %q: %s", csvfile, err)
+	}
+	if err := checkFilterColumns(filter, query, header); err != nil {
+		return selected, err
 	}
 	resultJson, err := json.MarshalIndent(&rows, "", "    ")
-	check(err)
+	if err != nil {
+		return selected, fmt.Errorf("Failed to encode rows from %q: %s", csvfile, err)
+	}
 
 	result := make([]map[string]interface{}, 0)
 	err = json.Unmarshal(resultJson, &result)
 	if err != nil {
-		return fmt.Errorf("command %q produced invalid JSON: %s", csvfile, err)
+		return selected, fmt.Errorf("command %q produced invalid JSON: %s", csvfile, err)
 	}
 
-	// poor mans filter to JSON array
-	filtered := make([]map[string]interface{}, 0)
+	// poor mans filter to JSON array. With no query or filter every row is
+	// selected.
+	selected.rows = make([]map[string]interface{}, 0)
+	selected.expiredHosts = make([]string, 0)
+	selected.expiringSoon = make([]string, 0)
+	selected.hostnames = make(map[string]bool, len(result))
 	log.Println("beginning filter search....")
-	if query != nil {
-		for _, item := range result {
-			var add = true
-			for q, v := range query {
-				log.Printf("item[%v] == %v\n", item[q].(string), v.(string))
-				endsWith := strings.HasSuffix(item[q].(string), v.(string))
-				if item[q] != v && !endsWith {
-					add = false
-				}
+	for i, item := range result {
+		selected.hostnames[fmt.Sprint(item["hostname"])] = true
+		var add = matchesQuery(item, query)
+		if add && filter != nil {
+			if add, err = filter.eval(item); err != nil {
+				return selected, fmt.Errorf("Failed to apply filter to host %q: %s", item["hostname"], err)
 			}
+		}
 
-			if item["expires"] == "" || item["expires"] == nil {
-				// set date to a year from now...
-				y, m, d := time.Now().Date()
-				item["expires"] = time.Date(y+1, m, d, 0, 0, 0, 0, time.Now().Location()).Format("2006-01-02")
-			}
-			item["power"] = "ignored" // default to ignored - we don't care about existing state as this could interfere
-			// with maintenance of existing machines.
-			date, err := time.Parse("2006-01-02", item["expires"].(string))
-			if err != nil {
-				// try formatting the date in dd/mm/YYYY format
-				// and yes, this is because of M$ excel f***ing with the format
-				date, err = time.Parse("02/01/2006", item["expires"].(string))
-				if err != nil {
-					return fmt.Errorf("Invalid date format for expires. Format should be 'YYYY-MM-DD'")
-				}
+		status, err := applyExpiry(item, policy, parser, today)
+		if err != nil {
+			return selected, fmt.Errorf("Failed to read CSV file %q: %s (%s): %s", csvfile, where[i], item["hostname"], err)
+		}
+
+		if add && status.keep {
+			selected.rows = append(selected.rows, item)
+			if status.expired {
+				selected.expiredHosts = append(selected.expiredHosts, item["hostname"].(string))
 			}
-			year, month, day := time.Now().Date()
-			delta := time.Date(year, month, day, 0, 0, 0, 0, time.Now().Location()).Sub(date).Hours()
-			if delta > 0 {
-				item["power"] = "poweredOff"
+			if status.expiringSoon {
+				selected.expiringSoon = append(selected.expiringSoon, item["hostname"].(string))
 			}
+		}
+	}
+	return selected, nil
+}
+
+// matchesQuery applies the legacy query map: a row matches when every column
+// equals, or ends with, the value given for it.
+func matchesQuery(item map[string]interface{}, query map[string]interface{}) bool {
+	for q, v := range query {
+		value, err := filterColumn(item, q)
+		if err != nil {
+			return false
+		}
+		log.Printf("item[%v] == %v\n", value, v)
+		if fmt.Sprint(value) != v.(string) && !strings.HasSuffix(fmt.Sprint(value), v.(string)) {
+			return false
+		}
+	}
+	return true
+}
+
+// enrichDisks fills in the disk and datastore attributes of a selected host,
+// from the existing VM when there is one and otherwise on the datastore
+// chosen by placement. position is the index of the row among the selected
+// rows. The vm_ attributes describe the existing VM.
+func enrichDisks(client *Client, item map[string]interface{}, position int, filter datastoreFilter, placement placementStrategy) error {
+	hostname := item["hostname"].(string)
+	log.Printf("============= RETRIEVING DISKS FOR %v >>>>>>>>>>>>>>>>>\n", hostname)
+	vmid, err := client.getVm(hostname)
+	if err != nil {
+		return fmt.Errorf("Failed to look up VM for host %q: %s", hostname, err)
+	}
+
+	var details map[string]interface{}
+	if vmid != "" {
+		details, err = client.getVmDetails(vmid)
+		if isNotFound(err) {
+			// removed since we listed it; treat it as not yet created
+			log.Printf("[INFO] VM %v for host %v has gone away", vmid, hostname)
+			details, err = nil, nil
+		}
+		if err != nil {
+			return fmt.Errorf("Failed to read VM details for host %q: %s", hostname, err)
+		}
+	}
 
-			// don't add any machines to the list that are > 7 days past expiry
-			// these should already have been moved in the state file by python.
-			if delta >= 168 { // 7 * 24 = 7 days
-				add = false
+	if details != nil {
+		disks, err := getDisks(details)
+		if err != nil {
+			return fmt.Errorf("Failed to read disks for host %q: %s", hostname, err)
+		}
+		entries := make([]interface{}, 0, len(disks))
+		for index, disk := range disks {
+			if disk.vmdk.file() == "" {
+				return fmt.Errorf("Invalid vmdk path %q for host %q", disk.vmdk, hostname)
 			}
+			entries = append(entries, map[string]interface{}{
+				"index":           index + 1,
+				"name":            disk.vmdk.base(),
+				"datastore":       disk.vmdk.datastore,
+				"path":            disk.vmdk.path,
+				"size_gb":         int((disk.capacity + 1<<29) >> 30),
+				"controller":      disk.controller(),
+				"unit_number":     disk.unit,
+				"label":           disk.label,
+				"controller_type": disk.controllerType,
+			})
+			// the flat attributes only hold disk1 to disk5
+			if index <= MAX_DISKS {
+				item[fmt.Sprintf("disk%v", (index+1))] = disk.vmdk.base()
+				item[fmt.Sprintf("disk%vlun", (index+1))] = disk.vmdk.datastore
+			}
+		}
+		item["disks"] = entries
+		log.Printf("Found %d disks\n", len(disks))
+
+		summary := getVmSummary(details)
+		item["vm_id"] = vmid
+		item["vm_cpu"] = summary.cpu
+		item["vm_memory"] = summary.memory
+		item["vm_power_state"] = summary.power
+		item["vm_guest_os"] = summary.guestOS
+		return nil
+	}
+
+	datastores, err := client.getDatastores(filter)
+	if err != nil {
+		return err
+	}
+	if len(datastores) == 0 {
+		return fmt.Errorf("no datastores on %s match %s", client.server, filter)
+	}
+	lun, err := placement.place(item, position, datastores)
+	if err != nil {
+		return fmt.Errorf("Failed to place disks for host %q: %s", hostname, err)
+	}
+	count := MAX_DISKS + 1
+	if n, ok := filterNumber(item["disk_count"]); ok {
+		count = int(n)
+	}
+	entries := make([]interface{}, 0, count)
+	for i := 0; i < count; i++ {
+		diskName := fmt.Sprintf("%v_%d", hostname, (i + 1))
+		if i == 0 {
+			diskName = hostname
+		}
+		if i <= MAX_DISKS {
+			item[fmt.Sprintf("disk%v", (i+1))] = diskName
+			item[fmt.Sprintf("disk%vlun", (i+1))] = lun
+		}
+		entries = append(entries, map[string]interface{}{
+			"index":     i + 1,
+			"name":      diskName,
+			"datastore": lun,
+			"path":      fmt.Sprintf("%v/%v.vmdk", hostname, diskName),
+		})
+	}
+	item["disks"] = entries
+	return nil
+}
+
+// sortRows orders rows by the given columns, comparing numerically where
+// both values are numbers. A column prefixed with "-" sorts descending.
+// Rows that compare equal keep their CSV order.
+func sortRows(rows []map[string]interface{}, sortBy []string) error {
+	if len(sortBy) == 0 || len(rows) == 0 {
+		return nil
+	}
+	for _, column := range sortBy {
+		if _, err := filterColumn(rows[0], strings.TrimPrefix(column, "-")); err != nil {
+			return fmt.Errorf("Invalid sort_by: %s", err)
+		}
+	}
 
-			if add {
-				log.Printf("============= RETRIEVING DISKS FOR %v >>>>>>>>>>>>>>>>>\n", item["hostname"].(string))
-				lun := randomDS(clusterPrefix)
-				vmid, err := getVm(item["hostname"].(string))
-				if err != nil {
-					panic(err.Error())
-				}
-
-				if vmid != "" {
-					details := getVmDetails(vmid)
-					disks := getDisks(details)
-					for index, value := range disks {
-						if index >= MAX_DISKS {
-							break
-						}
-						item[fmt.Sprintf("disk%v", (index+1))] = getImage(strings.Split(value, " ")[1])
-						item[fmt.Sprintf("disk%vlun", (index+1))] = getLun(strings.Split(value, " ")[0])
-					}
-					log.Printf("Found %d disks\n", len(disks))
-				} else {
-					for i := 0; i <= MAX_DISKS; i++ {
-						diskName := fmt.Sprintf("%v_%d", item["hostname"], (i + 1))
-						if i == 0 {
-							diskName = item["hostname"].(string)
-						}
-						item[fmt.Sprintf("disk%v", (i+1))] = diskName
-						item[fmt.Sprintf("disk%vlun", (i+1))] = lun
-					}
-				}
-
-				filtered = append(filtered, item)
-				log.Printf(
-					"============= (%d hosts for vapp %v - size %v) >>>>>>>>>>>>>>>>>\n",
-					len(filtered),
-					item["vapp"],
-					item["template"])
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, column := range sortBy {
+			desc := strings.HasPrefix(column, "-")
+			column = strings.TrimPrefix(column, "-")
+			a, _ := filterColumn(rows[i], column)
+			b, _ := filterColumn(rows[j], column)
+
+			cmp := compareValues(a, b)
+			if cmp == 0 {
+				continue
+			}
+			if desc {
+				return cmp > 0
 			}
+			return cmp < 0
+		}
+		return false
+	})
+	return nil
+}
+
+func compareValues(a, b interface{}) int {
+	x, xok := filterNumber(a)
+	y, yok := filterNumber(b)
+	if xok && yok {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
 		}
+		return 0
 	}
+	return strings.Compare(fmt.Sprint(a), fmt.Sprint(b))
+}
 
-	log.Println("============= FILTERED >>>>>>>>>>>>>>>>>")
-	for i := range filtered {
-		log.Println(filtered[i])
+// pageRows returns at most limit rows starting at offset. A limit of 0 means
+// no limit.
+func pageRows(rows []map[string]interface{}, offset, limit int) []map[string]interface{} {
+	if offset >= len(rows) {
+		return rows[:0]
 	}
-	log.Println("<<<<<<<<<<<<<=================")
+	rows = rows[offset:]
+	if limit > 0 && limit < len(rows) {
+		rows = rows[:limit]
+	}
+	return rows
+}
 
-	d.Set("result", &filtered)
-	d.SetId("-")
+// applyDialect sets the delimited text options of the data source on
+// reader. Only skip_rows applies to xlsx workbooks, and none of them apply to
+// json or yaml.
+func applyDialect(reader sourceReader, d *schema.ResourceData) error {
+	delimiter := d.Get("delimiter").(string)
+	comment := d.Get("comment").(string)
+	lazyQuotes := d.Get("lazy_quotes").(bool)
+	trimLeadingSpace := d.Get("trim_leading_space").(bool)
+	skipRows := d.Get("skip_rows").(int)
+
+	switch r := reader.(type) {
+	case *csvReader:
+		if delimiter != "" {
+			r.comma = []rune(delimiter)[0]
+		}
+		if comment != "" {
+			r.comment = []rune(comment)[0]
+		}
+		r.lazyQuotes = r.lazyQuotes || lazyQuotes
+		r.trimLeadingSpace = trimLeadingSpace
+		r.skipRows = skipRows
+		if r.comma == r.comment {
+			return fmt.Errorf("delimiter and comment must be different characters")
+		}
+		return nil
+	case *xlsxReader:
+		r.skipRows = skipRows
+		if delimiter != "" || comment != "" || lazyQuotes || trimLeadingSpace {
+			return fmt.Errorf("delimiter, comment, lazy_quotes and trim_leading_space can't be used with xlsx workbooks")
+		}
+		return nil
+	}
+	if delimiter != "" || comment != "" || lazyQuotes || trimLeadingSpace || skipRows != 0 {
+		return fmt.Errorf("delimiter, comment, lazy_quotes, trim_leading_space and skip_rows only apply to csv, tsv and xlsx")
+	}
 	return nil
 }
@@ -2,14 +2,17 @@ package csvhost
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"testing"
 
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
@@ -128,3 +131,236 @@ func buildDataSourceTestProgram() (string, error) {
 	)
 	return programPath, nil
 }
+
+func TestSortRows(t *testing.T) {
+	rows := []map[string]interface{}{
+		{"hostname": "web02", "cpu": 2, "vapp": "web"},
+		{"hostname": "db01", "cpu": 8, "vapp": "db"},
+		{"hostname": "web01", "cpu": 10, "vapp": "web"},
+		{"hostname": "web03", "cpu": 2, "vapp": "web"},
+	}
+
+	if err := sortRows(rows, []string{"vapp", "-cpu"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []string{"db01", "web01", "web02", "web03"}
+	for i, host := range want {
+		if rows[i]["hostname"] != host {
+			t.Fatalf("row %d is %v; want %s", i, rows[i]["hostname"], host)
+		}
+	}
+
+	if err := sortRows(rows, []string{"colour"}); err == nil {
+		t.Fatal("expected an error sorting by an unknown column")
+	}
+}
+
+func TestPageRows(t *testing.T) {
+	rows := make([]map[string]interface{}, 5)
+	for i := range rows {
+		rows[i] = map[string]interface{}{"cpu": i}
+	}
+
+	cases := []struct {
+		offset, limit int
+		want          []int
+	}{
+		{0, 0, []int{0, 1, 2, 3, 4}},
+		{1, 2, []int{1, 2}},
+		{3, 10, []int{3, 4}},
+		{5, 1, []int{}},
+	}
+
+	for _, tc := range cases {
+		page := pageRows(rows, tc.offset, tc.limit)
+		if len(page) != len(tc.want) {
+			t.Errorf("offset %d limit %d: got %d rows; want %d", tc.offset, tc.limit, len(page), len(tc.want))
+			continue
+		}
+		for i, cpu := range tc.want {
+			if page[i]["cpu"] != cpu {
+				t.Errorf("offset %d limit %d: row %d is %v; want %d", tc.offset, tc.limit, i, page[i]["cpu"], cpu)
+			}
+		}
+	}
+}
+
+func TestDataSourceRead(t *testing.T) {
+	inventory, err := ioutil.TempFile("", "csvhost-read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(inventory.Name())
+	inventory.WriteString(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small
+db01,10.0.0.20,10.0.0.1,24,4,8192,db,vlan10,large
+web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small
+web03,10.0.0.12,10.0.0.1,24,2,4096,web,vlan10,small
+`)
+	inventory.Close()
+
+	responses := map[string]interface{}{
+		"GET /rest/vcenter/datastore": []interface{}{
+			map[string]interface{}{"datastore": "datastore-1", "name": "ds1", "type": "VMFS", "free_space": float64(100 << 30)},
+		},
+	}
+	for _, host := range []string{"web01", "db01", "web02", "web03"} {
+		responses["GET /rest/vcenter/vm?filter.names.1="+host] = []interface{}{}
+	}
+	vcenter, client := newTestVCenter(responses)
+	defer vcenter.Close()
+
+	cases := []struct {
+		name   string
+		config map[string]interface{}
+		want   []string
+	}{
+		{"no query", map[string]interface{}{}, []string{"web01", "db01", "web02", "web03"}},
+		{"query", map[string]interface{}{
+			"query": map[string]interface{}{"vapp": "web"},
+		}, []string{"web01", "web02", "web03"}},
+		{"query with paging", map[string]interface{}{
+			"query":  map[string]interface{}{"vapp": "web"},
+			"offset": 1,
+			"limit":  1,
+		}, []string{"web02"}},
+	}
+
+	for _, tc := range cases {
+		tc.config["csvfile"] = inventory.Name()
+		tc.config["format"] = "csv"
+		d := schema.TestResourceDataRaw(t, dataSource().Schema, tc.config)
+		if err := dataSourceRead(d, client); err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+
+		result := d.Get("result").([]interface{})
+		got := make([]string, len(result))
+		for i, row := range result {
+			got[i] = row.(map[string]interface{})["hostname"].(string)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v; want %v", tc.name, got, tc.want)
+		}
+		if lun := d.Get("result.0.disk1lun"); lun != "ds1" {
+			t.Errorf("%s: first host placed on %v", tc.name, lun)
+		}
+	}
+}
+
+func TestDataSourceRead_roundRobinPage(t *testing.T) {
+	inventory, err := ioutil.TempFile("", "csvhost-read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(inventory.Name())
+	inventory.WriteString(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+web03,10.0.0.12,10.0.0.1,24,2,4096,web,vlan10,small
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small
+web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small
+`)
+	inventory.Close()
+
+	responses := map[string]interface{}{
+		"GET /rest/vcenter/datastore": []interface{}{
+			map[string]interface{}{"datastore": "datastore-1", "name": "ds1", "type": "VMFS", "free_space": float64(100 << 30)},
+			map[string]interface{}{"datastore": "datastore-2", "name": "ds2", "type": "VMFS", "free_space": float64(100 << 30)},
+			map[string]interface{}{"datastore": "datastore-3", "name": "ds3", "type": "VMFS", "free_space": float64(100 << 30)},
+		},
+	}
+	for _, host := range []string{"web01", "web02", "web03"} {
+		responses["GET /rest/vcenter/vm?filter.names.1="+host] = []interface{}{}
+	}
+	vcenter, client := newTestVCenter(responses)
+	defer vcenter.Close()
+
+	// a host is placed by its position in the sorted rows, not the page
+	placed := make(map[string]interface{})
+	for offset := 0; offset < 3; offset++ {
+		d := schema.TestResourceDataRaw(t, dataSource().Schema, map[string]interface{}{
+			"csvfile":   inventory.Name(),
+			"format":    "csv",
+			"placement": "round_robin",
+			"sort_by":   []interface{}{"hostname"},
+			"offset":    offset,
+			"limit":     1,
+		})
+		if err := dataSourceRead(d, client); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		placed[d.Get("result.0.hostname").(string)] = d.Get("result.0.disk1lun")
+	}
+	want := map[string]interface{}{"web01": "ds1", "web02": "ds2", "web03": "ds3"}
+	if !reflect.DeepEqual(placed, want) {
+		t.Fatalf("got %v; want %v", placed, want)
+	}
+}
+
+func TestEnrichDisks_existingVm(t *testing.T) {
+	disks := make([]interface{}, 0)
+	for i := 0; i < 6; i++ {
+		vmdk := "[ds1] web01/web01.vmdk"
+		if i > 0 {
+			vmdk = fmt.Sprintf("[ds1] web01/web01_%d.vmdk", i)
+		}
+		disks = append(disks, testDisk(fmt.Sprintf("Hard disk %d", i+1), vmdk, 0, i))
+	}
+	vcenter, client := newTestVCenter(map[string]interface{}{
+		"GET /rest/vcenter/vm?filter.names.1=web01": []interface{}{
+			map[string]interface{}{"vm": "vm-1", "name": "web01"},
+		},
+		"GET /rest/vcenter/vm/vm-1": map[string]interface{}{"disks": disks},
+	})
+	defer vcenter.Close()
+
+	item := map[string]interface{}{"hostname": "web01"}
+	if err := enrichDisks(client, item, 0, datastoreFilter{}, &hashPlacement{}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if item["disk5"] != "web01_4" || item["disk5lun"] != "ds1" {
+		t.Fatalf("fifth disk is %v on %v", item["disk5"], item["disk5lun"])
+	}
+	if _, ok := item["disk6"]; ok {
+		t.Fatal("sixth disk set as a flat attribute")
+	}
+	if n := len(item["disks"].([]interface{})); n != 6 {
+		t.Fatalf("got %d disks", n)
+	}
+}
+
+func TestEnrichDisks_diskCount(t *testing.T) {
+	vcenter, client := newTestVCenter(map[string]interface{}{
+		"GET /rest/vcenter/vm?filter.names.1=web01": []interface{}{},
+		"GET /rest/vcenter/datastore": []interface{}{
+			map[string]interface{}{"datastore": "datastore-1", "name": "ds1", "type": "VMFS"},
+		},
+	})
+	defer vcenter.Close()
+
+	cases := []struct {
+		count interface{}
+		want  int
+	}{
+		{nil, MAX_DISKS + 1},
+		{float64(2), 2},
+		{float64(7), 7},
+	}
+	for _, tc := range cases {
+		item := map[string]interface{}{"hostname": "web01"}
+		if tc.count != nil {
+			item["disk_count"] = tc.count
+		}
+		if err := enrichDisks(client, item, 0, datastoreFilter{}, &hashPlacement{}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if n := len(item["disks"].([]interface{})); n != tc.want {
+			t.Errorf("disk_count %v: planned %d disks; want %d", tc.count, n, tc.want)
+		}
+		_, third := item["disk3"]
+		_, sixth := item["disk6"]
+		if third != (tc.want >= 3) || sixth {
+			t.Errorf("disk_count %v: flat attributes are %v", tc.count, item)
+		}
+	}
+}
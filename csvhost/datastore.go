@@ -0,0 +1,409 @@
+package csvhost
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// datastore is an entry from the vCenter datastore list.
+type datastore struct {
+	id        string
+	name      string
+	kind      string // VMFS, NFS, VSAN...
+	freeSpace int64
+	capacity  int64
+}
+
+// datastorePath is a file on a datastore, written as
+// "[datastore name] folder/file.vmdk". Datastore names may contain spaces
+// and the file may be any number of folders deep.
+type datastorePath struct {
+	datastore string
+	path      string // "/" separated, relative to the top of the datastore
+}
+
+func parseDatastorePath(text string) (datastorePath, error) {
+	var p datastorePath
+	if !strings.HasPrefix(text, "[") {
+		return p, fmt.Errorf("datastore path %q doesn't start with [datastore]", text)
+	}
+	end := strings.Index(text, "]")
+	if end < 0 {
+		return p, fmt.Errorf("datastore path %q has no closing ]", text)
+	}
+	p.datastore = text[1:end]
+	if strings.TrimSpace(p.datastore) == "" {
+		return p, fmt.Errorf("datastore path %q has no datastore name", text)
+	}
+	p.path = strings.TrimLeft(text[end+1:], " ")
+	return p, nil
+}
+
+func (p datastorePath) String() string {
+	if p.path == "" {
+		return fmt.Sprintf("[%s]", p.datastore)
+	}
+	return fmt.Sprintf("[%s] %s", p.datastore, p.path)
+}
+
+// dir returns the folder holding the file, or "" at the top of the
+// datastore.
+func (p datastorePath) dir() string {
+	if dir := path.Dir(p.path); dir != "." && dir != "/" {
+		return dir
+	}
+	return ""
+}
+
+// file returns the name of the file, e.g. "web01_1.vmdk".
+func (p datastorePath) file() string {
+	if p.path == "" {
+		return ""
+	}
+	return path.Base(p.path)
+}
+
+// base returns the name of the file without its extension, e.g. "web01_1".
+func (p datastorePath) base() string {
+	file := p.file()
+	return strings.TrimSuffix(file, path.Ext(file))
+}
+
+var datastoreTypes = []string{"VMFS", "NFS", "NFS41", "CIFS", "VSAN", "VFFS", "VVOL"}
+
+// datastoreFilter selects the datastores that disks of new hosts may be
+// placed on. Every setting that is given must match.
+type datastoreFilter struct {
+	prefix       string // name prefix, from clusterPrefix
+	datacenter   string
+	types        []string
+	minFreeSpace int64 // bytes
+	tags         []string
+}
+
+// datastoreFilterFromConfig reads the datastore_filter block of the data
+// source.
+func datastoreFilterFromConfig(prefix string, config []interface{}) datastoreFilter {
+	filter := datastoreFilter{prefix: prefix}
+	if len(config) == 0 || config[0] == nil {
+		return filter
+	}
+	values := config[0].(map[string]interface{})
+	filter.datacenter = values["datacenter"].(string)
+	for _, v := range values["types"].([]interface{}) {
+		filter.types = append(filter.types, strings.ToUpper(v.(string)))
+	}
+	filter.minFreeSpace = int64(values["min_free_space_gb"].(int)) << 30
+	for _, v := range values["tags"].([]interface{}) {
+		filter.tags = append(filter.tags, v.(string))
+	}
+	return filter
+}
+
+func (f datastoreFilter) String() string {
+	parts := make([]string, 0)
+	if f.prefix != "" {
+		parts = append(parts, fmt.Sprintf("prefix %q", f.prefix))
+	}
+	if f.datacenter != "" {
+		parts = append(parts, fmt.Sprintf("datacenter %q", f.datacenter))
+	}
+	if len(f.types) > 0 {
+		parts = append(parts, fmt.Sprintf("types %s", strings.Join(f.types, ", ")))
+	}
+	if f.minFreeSpace > 0 {
+		parts = append(parts, fmt.Sprintf("at least %d GB free", f.minFreeSpace>>30))
+	}
+	if len(f.tags) > 0 {
+		parts = append(parts, fmt.Sprintf("tags %s", strings.Join(f.tags, ", ")))
+	}
+	if len(parts) == 0 {
+		return "any datastore"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// validateDatastoreType is a validation function for datastore types.
+func validateDatastoreType(v interface{}, k string) (ws []string, errors []error) {
+	for _, t := range datastoreTypes {
+		if strings.EqualFold(t, v.(string)) {
+			return
+		}
+	}
+	errors = append(errors, fmt.Errorf("%q must be one of %s", k, strings.Join(datastoreTypes, ", ")))
+	return
+}
+
+// getDatastores returns the datastores that match filter. Results are cached
+// per filter for the life of the provider.
+func (c *Client) getDatastores(filter datastoreFilter) ([]datastore, error) {
+	key := filter.String()
+	c.mu.Lock()
+	cached, ok := c.datastores[key]
+	c.mu.Unlock()
+	if ok {
+		return cached, nil
+	}
+
+	params := url.Values{}
+	for i, t := range filter.types {
+		params.Set(fmt.Sprintf("filter.types.%d", i+1), t)
+	}
+	if filter.datacenter != "" {
+		datacenter, err := c.getID("datacenter", "datacenter", filter.datacenter)
+		if err != nil {
+			return nil, err
+		}
+		params.Set("filter.datacenters.1", datacenter)
+	}
+
+	what := "datastore"
+	if len(params) > 0 {
+		what += "?" + params.Encode()
+	}
+	value, err := c.query(what)
+	if err != nil {
+		return nil, err
+	}
+	all, err := parseDatastores(value)
+	if err != nil {
+		return nil, c.error(c.url("vcenter/"+what), 0, err)
+	}
+
+	var tagged map[string]bool
+	if len(filter.tags) > 0 {
+		if tagged, err = c.getTaggedDatastores(filter.tags); err != nil {
+			return nil, err
+		}
+	}
+
+	datastores := make([]datastore, 0)
+	for _, ds := range all {
+		if !strings.HasPrefix(ds.name, filter.prefix) || ds.freeSpace < filter.minFreeSpace {
+			continue
+		}
+		if tagged != nil && !tagged[ds.id] {
+			continue
+		}
+		datastores = append(datastores, ds)
+	}
+
+	c.mu.Lock()
+	if c.datastores == nil {
+		c.datastores = make(map[string][]datastore)
+	}
+	c.datastores[key] = datastores
+	c.mu.Unlock()
+	return datastores, nil
+}
+
+// parseDatastores reads the value of a datastore list response.
+func parseDatastores(value interface{}) ([]datastore, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a list of datastores, got %T", value)
+	}
+	datastores := make([]datastore, 0, len(list))
+	for _, v := range list {
+		entry, _ := v.(map[string]interface{})
+		name, ok := entry["name"].(string)
+		if !ok {
+			return nil, fmt.Errorf("datastore entry has no name")
+		}
+		ds := datastore{name: name}
+		ds.id, _ = entry["datastore"].(string)
+		ds.kind, _ = entry["type"].(string)
+		if n, ok := filterNumber(entry["free_space"]); ok {
+			ds.freeSpace = int64(n)
+		}
+		if n, ok := filterNumber(entry["capacity"]); ok {
+			ds.capacity = int64(n)
+		}
+		datastores = append(datastores, ds)
+	}
+	return datastores, nil
+}
+
+// getID returns the identifier of the vcenter object of the given kind and
+// name, e.g. getID("cluster", "cluster", "Odd") for "domain-c7".
+func (c *Client) getID(kind, idField, name string, filters ...string) (string, error) {
+	id, err := c.findID(kind, idField, name, filters...)
+	if err == nil && id == "" {
+		err = fmt.Errorf("no %s named %q on %s", kind, name, c.server)
+	}
+	return id, err
+}
+
+// findID is getID for objects that may not exist, returning "" when there
+// isn't one.
+func (c *Client) findID(kind, idField, name string, filters ...string) (string, error) {
+	what := fmt.Sprintf("%s?filter.names.1=%s", kind, url.QueryEscape(name))
+	for _, f := range filters {
+		what += "&" + f
+	}
+	value, err := c.query(what)
+	if err != nil {
+		return "", err
+	}
+	list, _ := value.([]interface{})
+	if len(list) == 0 {
+		return "", nil
+	} else if len(list) > 1 {
+		return "", fmt.Errorf("Multiple %ss found with name %v", kind, name)
+	}
+	entry, _ := list[0].(map[string]interface{})
+	id, ok := entry[idField].(string)
+	if !ok {
+		return "", c.error(c.url("vcenter/"+what), 0, fmt.Errorf("%s entry has no id", kind))
+	}
+	return id, nil
+}
+
+// getTaggedDatastores returns the identifiers of the datastores that have
+// every one of the named tags.
+func (c *Client) getTaggedDatastores(names []string) (map[string]bool, error) {
+	ids, err := c.findTags(names)
+	if err != nil {
+		return nil, err
+	}
+
+	var tagged map[string]bool
+	for _, name := range names {
+		id := ids[name]
+		value, err := c.value(http.MethodPost,
+			"com/vmware/cis/tagging/tag-association/id:"+url.PathEscape(id)+"?~action=list-attached-objects")
+		if err != nil {
+			return nil, err
+		}
+		objects, _ := value.([]interface{})
+		attached := make(map[string]bool, len(objects))
+		for _, o := range objects {
+			object, _ := o.(map[string]interface{})
+			if object["type"] == "Datastore" {
+				attached[fmt.Sprint(object["id"])] = true
+			}
+		}
+		tagged = intersectIDs(tagged, attached)
+	}
+	return tagged, nil
+}
+
+// tagInfo is a tag read from the tagging API.
+type tagInfo struct {
+	id, name, category string // category is the category's id
+}
+
+// findTags returns the identifiers of the named tags. Tag names are only
+// unique within a category, so a tag may be written "category/name"; a bare
+// name that is in more than one category is an error.
+//
+// The tagging API can't look tags up by name, so each tag of a category is
+// read to find its name. Naming the category limits this to the tags of that
+// category; a bare name means reading every tag.
+func (c *Client) findTags(names []string) (map[string]string, error) {
+	bare := false
+	categories := make(map[string]string) // name to id
+	for _, name := range names {
+		if i := strings.Index(name, "/"); i >= 0 {
+			categories[name[:i]] = ""
+		} else {
+			bare = true
+		}
+	}
+
+	var tagIDs []interface{}
+	if len(categories) > 0 {
+		value, err := c.value(http.MethodGet, "com/vmware/cis/tagging/category")
+		if err != nil {
+			return nil, err
+		}
+		list, _ := value.([]interface{})
+		for _, v := range list {
+			id, _ := v.(string)
+			category, err := c.value(http.MethodGet, "com/vmware/cis/tagging/category/id:"+url.PathEscape(id))
+			if err != nil {
+				return nil, err
+			}
+			entry, _ := category.(map[string]interface{})
+			name, _ := entry["name"].(string)
+			if _, ok := categories[name]; ok {
+				categories[name] = id
+			}
+		}
+		for name, id := range categories {
+			if id == "" {
+				return nil, fmt.Errorf("no tag category named %q on %s", name, c.server)
+			}
+			if bare {
+				continue // every tag is read anyway
+			}
+			value, err := c.value(http.MethodPost,
+				"com/vmware/cis/tagging/tag/id:"+url.PathEscape(id)+"?~action=list-tags-for-category")
+			if err != nil {
+				return nil, err
+			}
+			list, _ := value.([]interface{})
+			tagIDs = append(tagIDs, list...)
+		}
+	}
+	if bare {
+		value, err := c.value(http.MethodGet, "com/vmware/cis/tagging/tag")
+		if err != nil {
+			return nil, err
+		}
+		tagIDs, _ = value.([]interface{})
+	}
+
+	tags := make(map[string][]tagInfo) // name to tags
+	for _, v := range tagIDs {
+		id, _ := v.(string)
+		value, err := c.value(http.MethodGet, "com/vmware/cis/tagging/tag/id:"+url.PathEscape(id))
+		if err != nil {
+			return nil, err
+		}
+		entry, _ := value.(map[string]interface{})
+		tag := tagInfo{id: id}
+		tag.name, _ = entry["name"].(string)
+		tag.category, _ = entry["category_id"].(string)
+		tags[tag.name] = append(tags[tag.name], tag)
+	}
+
+	ids := make(map[string]string, len(names))
+	for _, name := range names {
+		category, tagName := "", name
+		if i := strings.Index(name, "/"); i >= 0 {
+			category, tagName = categories[name[:i]], name[i+1:]
+		}
+		matches := make([]string, 0)
+		for _, tag := range tags[tagName] {
+			if category == "" || tag.category == category {
+				matches = append(matches, tag.id)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no tag named %q on %s", name, c.server)
+		} else if len(matches) > 1 {
+			return nil, fmt.Errorf("tag %q is in more than one category on %s; write it as category/name", name, c.server)
+		}
+		ids[name] = matches[0]
+	}
+	return ids, nil
+}
+
+// intersectIDs returns the identifiers in both sets; a nil set holds
+// everything.
+func intersectIDs(a, b map[string]bool) map[string]bool {
+	if a == nil {
+		return b
+	}
+	both := make(map[string]bool)
+	for id := range a {
+		if b[id] {
+			both[id] = true
+		}
+	}
+	return both
+}
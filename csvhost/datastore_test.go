@@ -0,0 +1,226 @@
+package csvhost
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestParseDatastores(t *testing.T) {
+	value := []interface{}{
+		map[string]interface{}{"datastore": "datastore-1", "name": "Odd_ds1", "type": "VMFS", "free_space": float64(1024), "capacity": float64(4096)},
+	}
+	datastores, err := parseDatastores(value)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := datastore{id: "datastore-1", name: "Odd_ds1", kind: "VMFS", freeSpace: 1024, capacity: 4096}
+	if len(datastores) != 1 || datastores[0] != want {
+		t.Fatalf("got %+v", datastores)
+	}
+
+	if _, err := parseDatastores([]interface{}{map[string]interface{}{"datastore": "datastore-1"}}); err == nil {
+		t.Fatal("expected an error for a datastore without a name")
+	}
+}
+
+func TestDatastoreFilterFromConfig(t *testing.T) {
+	filter := datastoreFilterFromConfig("Odd", []interface{}{
+		map[string]interface{}{
+			"datacenter":        "Odd",
+			"types":             []interface{}{"vmfs", "NFS"},
+			"min_free_space_gb": 100,
+			"tags":              []interface{}{"gold"},
+		},
+	})
+
+	want := `prefix "Odd", datacenter "Odd", types VMFS, NFS, at least 100 GB free, tags gold`
+	if filter.String() != want {
+		t.Fatalf("got %s", filter)
+	}
+	if filter.minFreeSpace != 100<<30 {
+		t.Fatalf("got %d bytes", filter.minFreeSpace)
+	}
+
+	if s := datastoreFilterFromConfig("", nil).String(); s != "any datastore" {
+		t.Fatalf("got %s", s)
+	}
+}
+
+func TestDatastoreFilter_removed(t *testing.T) {
+	for _, key := range []string{"cluster", "datastore_cluster"} {
+		raw, err := config.NewRawConfig(map[string]interface{}{
+			"csvfile":          "hosts.csv",
+			"datastore_filter": []interface{}{map[string]interface{}{key: "Odd"}},
+		})
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		_, errs := dataSource().Validate(terraform.NewResourceConfig(raw))
+		if len(errs) != 1 || !strings.Contains(fmt.Sprint(errs), "use tags instead") {
+			t.Errorf("%s: expected an error pointing at tags, got %v", key, errs)
+		}
+	}
+}
+
+func testDatastoreResponses() map[string]interface{} {
+	const gb = float64(1 << 30)
+	attached := func(ids ...string) []interface{} {
+		objects := []interface{}{map[string]interface{}{"type": "VirtualMachine", "id": "vm-1"}}
+		for _, id := range ids {
+			objects = append(objects, map[string]interface{}{"type": "Datastore", "id": id})
+		}
+		return objects
+	}
+	return map[string]interface{}{
+		"GET /rest/vcenter/datacenter?filter.names.1=DC1": []interface{}{
+			map[string]interface{}{"datacenter": "datacenter-2", "name": "DC1"},
+		},
+		"GET /rest/vcenter/datacenter?filter.names.1=DC2": []interface{}{},
+		"GET /rest/vcenter/datastore?filter.datacenters.1=datacenter-2&filter.types.1=VMFS": []interface{}{
+			map[string]interface{}{"datastore": "datastore-1", "name": "Odd_ds1", "type": "VMFS", "free_space": 200 * gb},
+			map[string]interface{}{"datastore": "datastore-2", "name": "Odd_ds2", "type": "VMFS", "free_space": 50 * gb},
+			map[string]interface{}{"datastore": "datastore-3", "name": "Odd_ds3", "type": "VMFS", "free_space": 500 * gb},
+			map[string]interface{}{"datastore": "datastore-4", "name": "Even_ds1", "type": "VMFS", "free_space": 500 * gb},
+		},
+		"GET /rest/com/vmware/cis/tagging/category":                                                []interface{}{"cat-1", "cat-2", "cat-3"},
+		"GET /rest/com/vmware/cis/tagging/category/id:cat-1":                                       map[string]interface{}{"id": "cat-1", "name": "tier"},
+		"GET /rest/com/vmware/cis/tagging/category/id:cat-2":                                       map[string]interface{}{"id": "cat-2", "name": "speed"},
+		"GET /rest/com/vmware/cis/tagging/category/id:cat-3":                                       map[string]interface{}{"id": "cat-3", "name": "medal"},
+		"GET /rest/com/vmware/cis/tagging/tag":                                                     []interface{}{"tag-1", "tag-2", "tag-3"},
+		"GET /rest/com/vmware/cis/tagging/tag/id:tag-1":                                            map[string]interface{}{"id": "tag-1", "name": "gold", "category_id": "cat-1"},
+		"GET /rest/com/vmware/cis/tagging/tag/id:tag-2":                                            map[string]interface{}{"id": "tag-2", "name": "fast", "category_id": "cat-2"},
+		"GET /rest/com/vmware/cis/tagging/tag/id:tag-3":                                            map[string]interface{}{"id": "tag-3", "name": "gold", "category_id": "cat-3"},
+		"POST /rest/com/vmware/cis/tagging/tag/id:cat-1?~action=list-tags-for-category":            []interface{}{"tag-1"},
+		"POST /rest/com/vmware/cis/tagging/tag/id:cat-2?~action=list-tags-for-category":            []interface{}{"tag-2"},
+		"POST /rest/com/vmware/cis/tagging/tag/id:cat-3?~action=list-tags-for-category":            []interface{}{"tag-3"},
+		"POST /rest/com/vmware/cis/tagging/tag-association/id:tag-1?~action=list-attached-objects": attached("datastore-1", "datastore-2", "datastore-3", "datastore-4"),
+		"POST /rest/com/vmware/cis/tagging/tag-association/id:tag-2?~action=list-attached-objects": attached("datastore-1", "datastore-2", "datastore-4"),
+	}
+}
+
+func TestGetDatastores(t *testing.T) {
+	vcenter, client := newTestVCenter(testDatastoreResponses())
+	defer vcenter.Close()
+
+	filter := datastoreFilter{
+		prefix:       "Odd",
+		datacenter:   "DC1",
+		types:        []string{"VMFS"},
+		minFreeSpace: 100 << 30,
+		tags:         []string{"tier/gold", "fast"},
+	}
+	datastores, err := client.getDatastores(filter)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(datastores) != 1 || datastores[0].name != "Odd_ds1" {
+		t.Fatalf("got %+v", datastores)
+	}
+
+	// the datastores are only listed once for each filter
+	requests := len(vcenter.requests)
+	if _, err := client.getDatastores(filter); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(vcenter.requests) != requests {
+		t.Fatalf("datastores listed again: %v", vcenter.requests[requests:])
+	}
+}
+
+func TestGetDatastores_errors(t *testing.T) {
+	vcenter, client := newTestVCenter(testDatastoreResponses())
+	defer vcenter.Close()
+
+	cases := []struct {
+		filter datastoreFilter
+		err    string
+	}{
+		{datastoreFilter{datacenter: "DC2"}, `no datacenter named "DC2"`},
+		{datastoreFilter{datacenter: "DC1", types: []string{"VMFS"}, tags: []string{"tier/gold", "slow"}}, `no tag named "slow"`},
+		{datastoreFilter{datacenter: "DC1", types: []string{"VMFS"}, tags: []string{"speed/gold"}}, `no tag named "speed/gold"`},
+		{datastoreFilter{datacenter: "DC1", types: []string{"VMFS"}, tags: []string{"colour/gold"}}, `no tag category named "colour"`},
+		{datastoreFilter{datacenter: "DC1", types: []string{"VMFS"}, tags: []string{"gold"}}, `tag "gold" is in more than one category`},
+	}
+	for _, tc := range cases {
+		_, err := client.getDatastores(tc.filter)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: expected an error containing %q, got %v", tc.filter, tc.err, err)
+		}
+	}
+}
+
+func TestFindTags(t *testing.T) {
+	vcenter, client := newTestVCenter(testDatastoreResponses())
+	defer vcenter.Close()
+
+	ids, err := client.findTags([]string{"tier/gold", "medal/gold", "speed/fast"})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := map[string]string{"tier/gold": "tag-1", "medal/gold": "tag-3", "speed/fast": "tag-2"}
+	if !reflect.DeepEqual(ids, want) {
+		t.Fatalf("got %v; want %v", ids, want)
+	}
+
+	// with every tag qualified only the tags of those categories are read
+	vcenter.requests = nil
+	if _, err := client.findTags([]string{"speed/fast"}); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	for _, request := range vcenter.requests {
+		if request == "GET /rest/com/vmware/cis/tagging/tag" || strings.HasSuffix(request, "id:tag-1") {
+			t.Fatalf("read tags outside the category: %v", vcenter.requests)
+		}
+	}
+}
+
+func TestIntersectIDs(t *testing.T) {
+	a := map[string]bool{"datastore-1": true, "datastore-2": true}
+	b := map[string]bool{"datastore-2": true, "datastore-3": true}
+
+	if got := intersectIDs(nil, a); len(got) != 2 {
+		t.Fatalf("got %v", got)
+	}
+	if got := intersectIDs(a, b); len(got) != 1 || !got["datastore-2"] {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestParseDatastorePath(t *testing.T) {
+	cases := []struct {
+		text                       string
+		datastore, dir, file, base string
+	}{
+		{"[ds1] web01/web01.vmdk", "ds1", "web01", "web01.vmdk", "web01"},
+		{"[SAN 01] web01/web01_1.vmdk", "SAN 01", "web01", "web01_1.vmdk", "web01_1"},
+		{"[ds1] vm/sub/disk_1.vmdk", "ds1", "vm/sub", "disk_1.vmdk", "disk_1"},
+		{"[ds1] web01.vmdk", "ds1", "", "web01.vmdk", "web01"},
+		{"[ds1] web 01/web 01.v2.vmdk", "ds1", "web 01", "web 01.v2.vmdk", "web 01.v2"},
+		{"[ds1]", "ds1", "", "", ""},
+	}
+
+	for _, tc := range cases {
+		p, err := parseDatastorePath(tc.text)
+		if err != nil {
+			t.Errorf("%q: %s", tc.text, err)
+			continue
+		}
+		if p.datastore != tc.datastore || p.dir() != tc.dir || p.file() != tc.file || p.base() != tc.base {
+			t.Errorf("%q: got %q, %q, %q, %q", tc.text, p.datastore, p.dir(), p.file(), p.base())
+		}
+		if p.String() != tc.text {
+			t.Errorf("%q: round trip gave %q", tc.text, p.String())
+		}
+	}
+
+	for _, text := range []string{"", "ds1 web01/web01.vmdk", "[ds1 web01/web01.vmdk", "[] web01.vmdk"} {
+		if _, err := parseDatastorePath(text); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
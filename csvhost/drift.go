@@ -0,0 +1,323 @@
+package csvhost
+
+import (
+	"fmt"
+	"github.com/hashicorp/terraform/helper/schema"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// driftDifference is a field whose value in vCenter differs from the
+// inventory.
+type driftDifference struct {
+	field    string
+	expected string
+	actual   string
+}
+
+func driftDataSource() *schema.Resource {
+	// the inventory is read and selected with the same arguments as the
+	// csvhost data source. Every selected host is compared, so there is no
+	// paging or ordering, and nothing is placed.
+	arguments := make(map[string]*schema.Schema)
+	for k, v := range dataSource().Schema {
+		if v.Computed || k == "placement" || k == "sort_by" || k == "offset" || k == "limit" {
+			continue
+		}
+		arguments[k] = v
+	}
+
+	arguments["cluster"] = &schema.Schema{
+		Type:     schema.TypeString,
+		Optional: true,
+	}
+
+	arguments["drift"] = &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Resource{
+			Schema: map[string]*schema.Schema{
+				"hostname": &schema.Schema{
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"vm_id": &schema.Schema{
+					Type:     schema.TypeString,
+					Computed: true,
+				},
+				"fields": &schema.Schema{
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem: &schema.Schema{
+						Type: schema.TypeString,
+					},
+				},
+				"differences": &schema.Schema{
+					Type:     schema.TypeList,
+					Computed: true,
+					Elem: &schema.Resource{
+						Schema: map[string]*schema.Schema{
+							"field": &schema.Schema{
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+							"expected": &schema.Schema{
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+							"actual": &schema.Schema{
+								Type:     schema.TypeString,
+								Computed: true,
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	// missing_vms are selected hosts with no VM in vCenter
+	arguments["missing_vms"] = &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+	}
+
+	// unmanaged_vms are VMs in cluster, or in one of the vApps of the
+	// selected hosts, that aren't in the inventory at all
+	arguments["unmanaged_vms"] = &schema.Schema{
+		Type:     schema.TypeList,
+		Computed: true,
+		Elem: &schema.Schema{
+			Type: schema.TypeString,
+		},
+	}
+
+	return &schema.Resource{
+		Read:   driftDataSourceRead,
+		Schema: arguments,
+	}
+}
+
+func driftDataSourceRead(d *schema.ResourceData, meta interface{}) error {
+	client := meta.(*Client)
+	client.acquire()
+	defer client.release()
+	selected, err := selectRows(d, client)
+	if err != nil {
+		return err
+	}
+
+	networks, err := client.getNetworks()
+	if err != nil {
+		return fmt.Errorf("Failed to list networks: %s", err)
+	}
+
+	// the datastores disks may be on, when they are limited at all
+	var allowed map[string]bool
+	datastores := datastoreFilterFromConfig(d.Get("clusterPrefix").(string), d.Get("datastore_filter").([]interface{}))
+	if datastores.String() != "any datastore" {
+		list, err := client.getDatastores(datastores)
+		if err != nil {
+			return err
+		}
+		allowed = make(map[string]bool, len(list))
+		for _, ds := range list {
+			allowed[ds.name] = true
+		}
+	}
+
+	drift := make([]map[string]interface{}, 0)
+	missing := make([]string, 0)
+	vapps := make([]string, 0)
+	for _, item := range selected.rows {
+		hostname := item["hostname"].(string)
+		if vapp := fmt.Sprint(item["vapp"]); vapp != "" && !containsString(vapps, vapp) {
+			vapps = append(vapps, vapp)
+		}
+
+		vmid, err := client.getVm(hostname)
+		if err != nil {
+			return fmt.Errorf("Failed to look up VM for host %q: %s", hostname, err)
+		}
+		var details map[string]interface{}
+		if vmid != "" {
+			details, err = client.getVmDetails(vmid)
+			if isNotFound(err) {
+				details, err = nil, nil
+			}
+			if err != nil {
+				return fmt.Errorf("Failed to read VM details for host %q: %s", hostname, err)
+			}
+		}
+		if details == nil {
+			missing = append(missing, hostname)
+			continue
+		}
+
+		differences, err := hostDrift(item, details, networks, allowed)
+		if err != nil {
+			return fmt.Errorf("Failed to compare host %q: %s", hostname, err)
+		}
+		if len(differences) == 0 {
+			continue
+		}
+		fields := make([]interface{}, len(differences))
+		entries := make([]interface{}, len(differences))
+		for i, diff := range differences {
+			fields[i] = diff.field
+			entries[i] = map[string]interface{}{
+				"field":    diff.field,
+				"expected": diff.expected,
+				"actual":   diff.actual,
+			}
+		}
+		drift = append(drift, map[string]interface{}{
+			"hostname":    hostname,
+			"vm_id":       vmid,
+			"fields":      fields,
+			"differences": entries,
+		})
+	}
+
+	unmanaged, err := unmanagedVms(client, d.Get("cluster").(string), vapps, selected.hostnames)
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] %d hosts have drifted, %d have no VM and %d VMs aren't in the inventory",
+		len(drift), len(missing), len(unmanaged))
+
+	d.Set("drift", drift)
+	d.Set("missing_vms", missing)
+	d.Set("unmanaged_vms", unmanaged)
+	d.SetId("-")
+	return nil
+}
+
+// hostDrift compares an inventory row with the details of its VM: cpu,
+// memory, network, power (unless the row's power is ignored), disk count
+// (unless the row's disk_count is blank) and datastore (when allowed, the set
+// of datastores disks may be on, isn't nil).
+func hostDrift(item, details map[string]interface{}, networks map[string]string, allowed map[string]bool) ([]driftDifference, error) {
+	differences := make([]driftDifference, 0)
+	compare := func(field string, expected, actual interface{}) {
+		if e, a := fmt.Sprint(expected), fmt.Sprint(actual); compareValues(e, a) != 0 {
+			differences = append(differences, driftDifference{field, e, a})
+		}
+	}
+
+	summary := getVmSummary(details)
+	compare("cpu", item["cpu"], summary.cpu)
+	compare("memory", item["memory"], summary.memory)
+
+	vmNetworks := vmNetworkNames(details, networks)
+	if network := fmt.Sprint(item["network"]); !containsString(vmNetworks, network) {
+		differences = append(differences, driftDifference{"network", network, strings.Join(vmNetworks, ", ")})
+	}
+
+	if power := fmt.Sprint(item["power"]); power != "ignored" && power != "" {
+		compare("power", power, summary.power)
+	}
+
+	disks, err := getDisks(details)
+	if err != nil {
+		return nil, err
+	}
+	if count, ok := item["disk_count"]; ok {
+		compare("disk_count", count, len(disks))
+	}
+
+	if allowed != nil {
+		outside := make([]string, 0)
+		for _, disk := range disks {
+			if !allowed[disk.vmdk.datastore] && !containsString(outside, disk.vmdk.datastore) {
+				outside = append(outside, disk.vmdk.datastore)
+			}
+		}
+		if len(outside) > 0 {
+			differences = append(differences, driftDifference{"datastore", "an allowed datastore", strings.Join(outside, ", ")})
+		}
+	}
+	return differences, nil
+}
+
+// vmNetworkNames returns the names of the networks the NICs of a VM are
+// connected to.
+func vmNetworkNames(details map[string]interface{}, networks map[string]string) []string {
+	names := make([]string, 0)
+	nics, _ := details["nics"].([]interface{})
+	for _, n := range nics {
+		entry, _ := n.(map[string]interface{})
+		value, _ := entry["value"].(map[string]interface{})
+		backing, _ := value["backing"].(map[string]interface{})
+		name, _ := backing["network_name"].(string)
+		if name == "" {
+			id, _ := backing["network"].(string)
+			name = networks[id]
+		}
+		if name != "" && !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// unmanagedVms returns the VMs in cluster, or in one of vapps, that aren't
+// one of hostnames. vApps that don't exist yet are skipped.
+//
+// vCenter requires a VM to match every kind of filter given, so the cluster
+// and the vApps are listed separately and the results combined.
+func unmanagedVms(client *Client, cluster string, vapps []string, hostnames map[string]bool) ([]string, error) {
+	queries := make([]url.Values, 0, 2)
+	if cluster != "" {
+		id, err := client.getID("cluster", "cluster", cluster)
+		if err != nil {
+			return nil, err
+		}
+		queries = append(queries, url.Values{"filter.clusters.1": {id}})
+	}
+	pools := url.Values{}
+	for _, vapp := range vapps {
+		// vApps are listed as resource pools
+		id, err := client.findID("resource-pool", "resource_pool", vapp)
+		if err != nil {
+			return nil, err
+		}
+		if id == "" {
+			log.Printf("[INFO] No vApp found with name %v", vapp)
+			continue
+		}
+		pools.Set(fmt.Sprintf("filter.resource_pools.%d", len(pools)+1), id)
+	}
+	if len(pools) > 0 {
+		queries = append(queries, pools)
+	}
+
+	unmanaged := make([]string, 0)
+	for _, filters := range queries {
+		vms, err := client.getVmList(filters)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to list VMs: %s", err)
+		}
+		for _, name := range vms {
+			if !hostnames[name] && !containsString(unmanaged, name) {
+				unmanaged = append(unmanaged, name)
+			}
+		}
+	}
+	sort.Strings(unmanaged)
+	return unmanaged, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
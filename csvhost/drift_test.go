@@ -0,0 +1,184 @@
+package csvhost
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/helper/schema"
+)
+
+func testDriftDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"cpu":         map[string]interface{}{"count": float64(4)},
+		"memory":      map[string]interface{}{"size_MiB": float64(8192)},
+		"power_state": "POWERED_ON",
+		"nics": []interface{}{
+			map[string]interface{}{
+				"key":   "4000",
+				"value": map[string]interface{}{"backing": map[string]interface{}{"network": "network-12"}},
+			},
+		},
+		"disks": []interface{}{
+			testDisk("Hard disk 1", "[Odd_ds1] web01/web01.vmdk", 0, 0),
+			testDisk("Hard disk 2", "[Even_ds1] web01/web01_1.vmdk", 0, 1),
+		},
+	}
+}
+
+func TestHostDrift(t *testing.T) {
+	networks := map[string]string{"network-12": "vlan10"}
+	item := map[string]interface{}{
+		"hostname": "web01",
+		"cpu":      float64(4),
+		"memory":   float64(8192),
+		"network":  "vlan10",
+		"power":    "ignored",
+		"extra":    map[string]interface{}{},
+	}
+
+	differences, err := hostDrift(item, testDriftDetails(), networks, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(differences) != 0 {
+		t.Fatalf("unexpected drift: %+v", differences)
+	}
+
+	item["cpu"] = float64(2)
+	item["network"] = "vlan20"
+	item["power"] = "poweredOff"
+	item["disk_count"] = float64(3)
+	allowed := map[string]bool{"Odd_ds1": true}
+
+	differences, err = hostDrift(item, testDriftDetails(), networks, allowed)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	want := []driftDifference{
+		{"cpu", "2", "4"},
+		{"network", "vlan20", "vlan10"},
+		{"power", "poweredOff", "poweredOn"},
+		{"disk_count", "3", "2"},
+		{"datastore", "an allowed datastore", "Even_ds1"},
+	}
+	if !reflect.DeepEqual(differences, want) {
+		t.Fatalf("got %+v; want %+v", differences, want)
+	}
+}
+
+func TestVmNetworkNames(t *testing.T) {
+	details := map[string]interface{}{
+		"nics": []interface{}{
+			map[string]interface{}{"value": map[string]interface{}{"backing": map[string]interface{}{"network": "network-12"}}},
+			map[string]interface{}{"value": map[string]interface{}{"backing": map[string]interface{}{"network": "dvportgroup-3", "network_name": "vlan30"}}},
+			map[string]interface{}{"value": map[string]interface{}{"backing": map[string]interface{}{"network": "network-12"}}},
+		},
+	}
+
+	got := vmNetworkNames(details, map[string]string{"network-12": "vlan10"})
+	if !reflect.DeepEqual(got, []string{"vlan10", "vlan30"}) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func testDriftResponses() map[string]interface{} {
+	return map[string]interface{}{
+		"GET /rest/vcenter/network": []interface{}{
+			map[string]interface{}{"network": "network-12", "name": "vlan10"},
+		},
+		"GET /rest/vcenter/cluster?filter.names.1=Odd": []interface{}{
+			map[string]interface{}{"cluster": "domain-c7", "name": "Odd"},
+		},
+		"GET /rest/vcenter/resource-pool?filter.names.1=web": []interface{}{
+			map[string]interface{}{"resource_pool": "resgroup-v1", "name": "web"},
+		},
+		"GET /rest/vcenter/resource-pool?filter.names.1=db": []interface{}{},
+		"GET /rest/vcenter/vm?filter.clusters.1=domain-c7": []interface{}{
+			map[string]interface{}{"vm": "vm-1", "name": "web01"},
+			map[string]interface{}{"vm": "vm-3", "name": "db01"},
+			map[string]interface{}{"vm": "vm-4", "name": "stray01"},
+		},
+		"GET /rest/vcenter/vm?filter.resource_pools.1=resgroup-v1": []interface{}{
+			map[string]interface{}{"vm": "vm-1", "name": "web01"},
+			map[string]interface{}{"vm": "vm-5", "name": "web-old"},
+		},
+		"GET /rest/vcenter/vm?filter.names.1=web01": []interface{}{
+			map[string]interface{}{"vm": "vm-1", "name": "web01"},
+		},
+		"GET /rest/vcenter/vm?filter.names.1=web02": []interface{}{},
+		"GET /rest/vcenter/vm/vm-1":                 testDriftDetails(),
+	}
+}
+
+func TestUnmanagedVms(t *testing.T) {
+	vcenter, client := newTestVCenter(testDriftResponses())
+	defer vcenter.Close()
+
+	// VMs in the cluster or the vApp, not only those in both
+	hostnames := map[string]bool{"web01": true, "db01": true}
+	unmanaged, err := unmanagedVms(client, "Odd", []string{"web", "db"}, hostnames)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []string{"stray01", "web-old"}; !reflect.DeepEqual(unmanaged, want) {
+		t.Fatalf("got %v; want %v", unmanaged, want)
+	}
+
+	unmanaged, err = unmanagedVms(client, "", []string{"web"}, hostnames)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if want := []string{"web-old"}; !reflect.DeepEqual(unmanaged, want) {
+		t.Fatalf("got %v; want %v", unmanaged, want)
+	}
+}
+
+func TestDriftDataSourceRead(t *testing.T) {
+	inventory, err := ioutil.TempFile("", "csvhost-drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(inventory.Name())
+	inventory.WriteString(`hostname,address,gateway,subnet,cpu,memory,vapp,network,template,disk_count
+web01,10.0.0.10,10.0.0.1,24,2,8192,web,vlan10,small,3
+web02,10.0.0.11,10.0.0.1,24,2,4096,web,vlan10,small,
+db01,10.0.0.20,10.0.0.1,24,4,8192,db,vlan10,large,
+`)
+	inventory.Close()
+
+	vcenter, client := newTestVCenter(testDriftResponses())
+	defer vcenter.Close()
+
+	// db01 isn't selected but is still in the inventory, so it isn't
+	// unmanaged
+	d := schema.TestResourceDataRaw(t, driftDataSource().Schema, map[string]interface{}{
+		"csvfile": inventory.Name(),
+		"format":  "csv",
+		"filter":  `vapp == "web"`,
+		"cluster": "Odd",
+	})
+	if err := driftDataSourceRead(d, client); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if got := d.Get("drift.#"); got != 1 {
+		t.Fatalf("expected 1 drifted host, got %v", got)
+	}
+	if got := d.Get("drift.0.hostname"); got != "web01" {
+		t.Fatalf("drifted host is %v", got)
+	}
+	if got := d.Get("drift.0.fields").([]interface{}); !reflect.DeepEqual(got, []interface{}{"cpu", "disk_count"}) {
+		t.Fatalf("drifted fields are %v", got)
+	}
+	if got := d.Get("missing_vms").([]interface{}); !reflect.DeepEqual(got, []interface{}{"web02"}) {
+		t.Fatalf("missing VMs are %v", got)
+	}
+	if got := d.Get("unmanaged_vms").([]interface{}); !reflect.DeepEqual(got, []interface{}{"stray01", "web-old"}) {
+		t.Fatalf("unmanaged VMs are %v", got)
+	}
+	if vcenter.logouts != 1 {
+		t.Fatalf("expected the session to end with the read, got %d logouts", vcenter.logouts)
+	}
+}
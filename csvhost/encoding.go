@@ -0,0 +1,120 @@
+package csvhost
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	bomUTF8    = []byte{0xef, 0xbb, 0xbf}
+	bomUTF16LE = []byte{0xff, 0xfe}
+	bomUTF16BE = []byte{0xfe, 0xff}
+)
+
+// windows1252 maps the bytes 0x80-0x9f of Windows-1252 to Unicode; the rest
+// of the code page is the same as ISO-8859-1.
+var windows1252 = [32]rune{
+	'€', 0x81, '‚', 'ƒ', '„', '…', '†', '‡', 'ˆ', '‰', 'Š', '‹', 'Œ', 0x8d, 'Ž', 0x8f,
+	0x90, '‘', '’', '“', '”', '•', '–', '—', '˜', '™', 'š', '›', 'œ', 0x9d, 'ž', 'Ÿ',
+}
+
+var textEncodings = map[string]func([]byte) ([]byte, error){
+	"utf-8":        decodeUTF8,
+	"utf-16":       decodeUTF16BOM,
+	"utf-16le":     func(data []byte) ([]byte, error) { return decodeUTF16(data, false) },
+	"utf-16be":     func(data []byte) ([]byte, error) { return decodeUTF16(data, true) },
+	"iso-8859-1":   decodeLatin1,
+	"windows-1252": decodeWindows1252,
+}
+
+// decodeText converts data in the given encoding to UTF-8. When detectBOM is
+// set a byte order mark takes precedence over the encoding and is removed.
+func decodeText(data []byte, encoding string, detectBOM bool) ([]byte, error) {
+	if encoding == "" {
+		encoding = "utf-8"
+	}
+	if detectBOM {
+		switch {
+		case bytes.HasPrefix(data, bomUTF8):
+			return decodeUTF8(data[len(bomUTF8):])
+		case bytes.HasPrefix(data, bomUTF16LE):
+			return decodeUTF16(data[len(bomUTF16LE):], false)
+		case bytes.HasPrefix(data, bomUTF16BE):
+			return decodeUTF16(data[len(bomUTF16BE):], true)
+		}
+	}
+
+	decode, ok := textEncodings[strings.ToLower(encoding)]
+	if !ok {
+		return nil, fmt.Errorf("unknown encoding %q", encoding)
+	}
+	return decode(data)
+}
+
+func decodeUTF8(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, fmt.Errorf("data is not valid UTF-8; set encoding to the encoding of the file")
+	}
+	return data, nil
+}
+
+// decodeUTF16BOM decodes UTF-16 in the byte order given by its byte order
+// mark, defaulting to big endian.
+func decodeUTF16BOM(data []byte) ([]byte, error) {
+	if bytes.HasPrefix(data, bomUTF16LE) {
+		return decodeUTF16(data[len(bomUTF16LE):], false)
+	}
+	return decodeUTF16(bytes.TrimPrefix(data, bomUTF16BE), true)
+}
+
+func decodeUTF16(data []byte, bigEndian bool) ([]byte, error) {
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("UTF-16 data has an odd number of bytes")
+	}
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return []byte(string(utf16.Decode(units))), nil
+}
+
+func decodeLatin1(data []byte) ([]byte, error) {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		runes[i] = rune(b)
+	}
+	return []byte(string(runes)), nil
+}
+
+func decodeWindows1252(data []byte) ([]byte, error) {
+	runes := make([]rune, len(data))
+	for i, b := range data {
+		if b >= 0x80 && b <= 0x9f {
+			runes[i] = windows1252[b-0x80]
+		} else {
+			runes[i] = rune(b)
+		}
+	}
+	return []byte(string(runes)), nil
+}
+
+// validateEncoding is a validation function for the "encoding" attribute.
+func validateEncoding(v interface{}, k string) (ws []string, errors []error) {
+	if _, ok := textEncodings[strings.ToLower(v.(string))]; !ok {
+		encodings := make([]string, 0, len(textEncodings))
+		for e := range textEncodings {
+			encodings = append(encodings, e)
+		}
+		sort.Strings(encodings)
+		errors = append(errors, fmt.Errorf("%q must be one of %s", k, strings.Join(encodings, ", ")))
+	}
+	return
+}
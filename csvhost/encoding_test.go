@@ -0,0 +1,53 @@
+package csvhost
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecodeText(t *testing.T) {
+	cases := []struct {
+		name     string
+		data     []byte
+		encoding string
+		want     string
+	}{
+		{"utf-8 bom", append([]byte{0xef, 0xbb, 0xbf}, "hostname"...), "utf-8", "hostname"},
+		{"utf-16le bom", []byte{0xff, 0xfe, 'h', 0, 'o', 0, 's', 0, 't', 0}, "utf-8", "host"},
+		{"utf-16be bom", []byte{0xfe, 0xff, 0, 'h', 0, 'o', 0, 's', 0, 't'}, "utf-16", "host"},
+		{"utf-16le", []byte{'h', 0, 0xe9, 0}, "utf-16le", "hé"},
+		{"latin1", []byte{'c', 'a', 'f', 0xe9}, "iso-8859-1", "café"},
+		{"windows-1252", []byte{0x80, '5'}, "windows-1252", "€5"},
+	}
+
+	for _, tc := range cases {
+		got, err := decodeText(tc.data, tc.encoding, true)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %q; want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestDecodeText_noBOMDetection(t *testing.T) {
+	data := append([]byte{0xef, 0xbb, 0xbf}, "hostname"...)
+	got, err := decodeText(data, "utf-8", false)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("BOM was removed: %q", got)
+	}
+}
+
+func TestDecodeText_invalid(t *testing.T) {
+	if _, err := decodeText([]byte{'c', 'a', 'f', 0xe9}, "utf-8", true); err == nil {
+		t.Fatal("expected an error for invalid UTF-8")
+	}
+	if _, err := decodeText([]byte("a"), "ebcdic", true); err == nil {
+		t.Fatal("expected an error for an unknown encoding")
+	}
+}
@@ -0,0 +1,146 @@
+package csvhost
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// APIError describes a failed call to the vCenter REST API. It names the
+// vCenter host, the URL that was requested and, when a response was
+// received, the HTTP status that came back. Advice, when set, tells the user
+// what to do about it.
+type APIError struct {
+	Host   string
+	URL    string
+	Status int
+	Err    error
+	Advice string
+}
+
+func (e *APIError) Error() string {
+	var text string
+	if e.Status != 0 {
+		text = fmt.Sprintf("vCenter %s: %s (HTTP %d): %s", e.Host, e.URL, e.Status, e.Err)
+	} else {
+		text = fmt.Sprintf("vCenter %s: %s: %s", e.Host, e.URL, e.Err)
+	}
+	if e.Advice != "" {
+		text += "; " + e.Advice
+	}
+	return text
+}
+
+// advise sets the advice for failures the user can act on: rejected
+// credentials or permissions, and vCenter itself failing.
+func advise(err *APIError) *APIError {
+	switch {
+	case isUnauthorized(err):
+		err.Advice = "check the provider's user and password, and that the user may read VMs, datastores and tags"
+	case isServerError(err):
+		err.Advice = "vCenter failed to handle the request, try again once it is healthy"
+	}
+	return err
+}
+
+// DiskError is returned when the disk layout of an existing VM cannot be
+// understood.
+type DiskError struct {
+	Label string
+	Err   error
+}
+
+func (e *DiskError) Error() string {
+	return fmt.Sprintf("disk %q: %s", e.Label, e.Err)
+}
+
+// VAPIError is the error structure vCenter returns in the body of a failed
+// request, e.g. {"type":"com.vmware.vapi.std.errors.not_found","value":{...}}.
+type VAPIError struct {
+	Type     string
+	Messages []VAPIMessage
+}
+
+// VAPIMessage is a single message from a VAPIError.
+type VAPIMessage struct {
+	ID             string   `json:"id"`
+	DefaultMessage string   `json:"default_message"`
+	Args           []string `json:"args"`
+	Localized      string   `json:"localized"`
+}
+
+func (e *VAPIError) Error() string {
+	messages := make([]string, 0, len(e.Messages))
+	for _, m := range e.Messages {
+		switch {
+		case m.Localized != "":
+			messages = append(messages, m.Localized)
+		case m.DefaultMessage != "":
+			messages = append(messages, m.DefaultMessage)
+		case m.ID != "":
+			messages = append(messages, m.ID)
+		}
+	}
+	if len(messages) == 0 {
+		return e.Type
+	}
+	return fmt.Sprintf("%s: %s", e.Type, strings.Join(messages, "; "))
+}
+
+// decodeVAPIError reads a vAPI error body. It returns nil if the body isn't
+// one.
+func decodeVAPIError(body []byte) *VAPIError {
+	var data struct {
+		Type  string `json:"type"`
+		Value struct {
+			Messages []VAPIMessage `json:"messages"`
+		} `json:"value"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil || data.Type == "" {
+		return nil
+	}
+	return &VAPIError{Type: data.Type, Messages: data.Value.Messages}
+}
+
+func vapiErrorType(err error) string {
+	if e, ok := err.(*APIError); ok {
+		if v, ok := e.Err.(*VAPIError); ok {
+			return v.Type
+		}
+	}
+	return ""
+}
+
+func statusCode(err error) int {
+	if e, ok := err.(*APIError); ok {
+		return e.Status
+	}
+	return 0
+}
+
+// isNotFound reports whether err is vCenter saying the object doesn't exist.
+func isNotFound(err error) bool {
+	return statusCode(err) == http.StatusNotFound ||
+		vapiErrorType(err) == "com.vmware.vapi.std.errors.not_found"
+}
+
+// isUnauthorized reports whether err is vCenter rejecting the credentials or
+// the permissions of the configured user.
+func isUnauthorized(err error) bool {
+	switch vapiErrorType(err) {
+	case "com.vmware.vapi.std.errors.unauthenticated", "com.vmware.vapi.std.errors.unauthorized":
+		return true
+	}
+	status := statusCode(err)
+	return status == http.StatusUnauthorized || status == http.StatusForbidden
+}
+
+// isServerError reports whether err is a failure inside vCenter itself.
+func isServerError(err error) bool {
+	switch vapiErrorType(err) {
+	case "com.vmware.vapi.std.errors.internal_server_error", "com.vmware.vapi.std.errors.service_unavailable":
+		return true
+	}
+	return statusCode(err) >= 500
+}
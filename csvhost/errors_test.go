@@ -0,0 +1,73 @@
+package csvhost
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDecodeVAPIError(t *testing.T) {
+	body := []byte(`{
+		"type": "com.vmware.vapi.std.errors.not_found",
+		"value": {
+			"messages": [
+				{
+					"args": ["vm-42"],
+					"default_message": "Virtual machine with identifier 'vm-42' does not exist.",
+					"id": "com.vmware.api.vcenter.vm.not_found"
+				}
+			]
+		}
+	}`)
+
+	vapiErr := decodeVAPIError(body)
+	if vapiErr == nil {
+		t.Fatal("expected a vAPI error")
+	}
+	if vapiErr.Type != "com.vmware.vapi.std.errors.not_found" {
+		t.Fatalf("unexpected type %q", vapiErr.Type)
+	}
+	want := "com.vmware.vapi.std.errors.not_found: Virtual machine with identifier 'vm-42' does not exist."
+	if vapiErr.Error() != want {
+		t.Fatalf("got %q; want %q", vapiErr.Error(), want)
+	}
+
+	err := &APIError{Host: "vc", URL: "https://vc/rest/vcenter/vm/vm-42", Status: 404, Err: vapiErr}
+	if !isNotFound(err) || isUnauthorized(err) || isServerError(err) {
+		t.Fatalf("%s classified wrongly", err)
+	}
+}
+
+func TestDecodeVAPIError_notVAPI(t *testing.T) {
+	if err := decodeVAPIError([]byte(`<html>Service Unavailable</html>`)); err != nil {
+		t.Fatalf("expected nil, got %s", err)
+	}
+	if err := decodeVAPIError([]byte(`{"value": []}`)); err != nil {
+		t.Fatalf("expected nil, got %s", err)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	cases := []struct {
+		err          error
+		notFound     bool
+		unauthorized bool
+		serverError  bool
+	}{
+		{&APIError{Status: 401, Err: fmt.Errorf("401 Unauthorized")}, false, true, false},
+		{&APIError{Status: 403, Err: fmt.Errorf("403 Forbidden")}, false, true, false},
+		{&APIError{Status: 500, Err: fmt.Errorf("500 Internal Server Error")}, false, false, true},
+		{&APIError{Status: 400, Err: &VAPIError{Type: "com.vmware.vapi.std.errors.unauthenticated"}}, false, true, false},
+		{fmt.Errorf("not an API error"), false, false, false},
+	}
+
+	for i, tc := range cases {
+		if e, ok := tc.err.(*APIError); ok && advise(e).Advice == "" && (tc.unauthorized || tc.serverError) {
+			t.Errorf("%d: %s has no advice", i, tc.err)
+		}
+		if isNotFound(tc.err) != tc.notFound ||
+			isUnauthorized(tc.err) != tc.unauthorized ||
+			isServerError(tc.err) != tc.serverError {
+			t.Errorf("%d: %s classified wrongly", i, tc.err)
+		}
+	}
+}
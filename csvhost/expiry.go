@@ -0,0 +1,354 @@
+package csvhost
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// expiryPolicy decides, relative to the expires date of a host, when it is
+// given the expired power state and when it is dropped from the results.
+type expiryPolicy struct {
+	defaultLifetime   period // added to today for rows with a blank expires
+	gracePeriod       period // after expiry before the power state changes
+	expiredPowerState string
+	dropAfter         period // after expiry before the row is dropped
+	noticePeriod      period // before expiry that a host is expiring soon
+}
+
+var defaultExpiryPolicy = expiryPolicy{
+	defaultLifetime:   period{years: 1},
+	gracePeriod:       period{},
+	expiredPowerState: "poweredOff",
+	dropAfter:         period{days: 7},
+	noticePeriod:      period{days: 14},
+}
+
+// expiryColumns are the extra columns that override the expiry policy for a
+// single row.
+var expiryColumns = map[string]string{
+	"lifetime":            "default_lifetime",
+	"grace_period":        "grace_period",
+	"expired_power_state": "expired_power_state",
+	"drop_after":          "drop_after",
+	"notice_period":       "notice_period",
+}
+
+var powerStates = []string{"poweredOff", "poweredOn", "suspended", "ignored"}
+
+// defaultExpiresFormats are the formats tried, in order, when parsing an expires
+// date. Besides Go time layouts, "rfc3339" accepts timestamps such as
+// "2020-06-10T17:00:00Z" and "excel" accepts the serial day numbers that
+// spreadsheets store dates as.
+var defaultExpiresFormats = []string{"2006-01-02", "02/01/2006", "rfc3339", "excel"}
+
+// excelEpoch is day 0 of the spreadsheet date system. It is 30 December
+// rather than 31 December 1899 because Excel counts a 29 February 1900 that
+// never happened, which only matters for dates before March 1900.
+var excelEpoch = time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+
+// expiresParser parses the expires column of a row.
+type expiresParser struct {
+	formats  []string
+	location *time.Location // for dates without a zone, and for today
+}
+
+var defaultExpiresParser = expiresParser{formats: defaultExpiresFormats, location: time.Local}
+
+// expiresParserFromConfig builds the parser for the expires_formats and
+// timezone attributes of the data source.
+func expiresParserFromConfig(formats []interface{}, timezone string) (expiresParser, error) {
+	parser := defaultExpiresParser
+	if len(formats) > 0 {
+		parser.formats = make([]string, len(formats))
+		for i, f := range formats {
+			parser.formats[i] = f.(string)
+		}
+	}
+	if timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return parser, fmt.Errorf("Invalid timezone %q: %s", timezone, err)
+		}
+		parser.location = location
+	}
+	return parser, nil
+}
+
+// parse returns the date in the first format that matches text.
+func (p expiresParser) parse(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	for _, format := range p.formats {
+		switch format {
+		case "rfc3339":
+			if date, err := time.Parse(time.RFC3339, text); err == nil {
+				return date.In(p.location), nil
+			}
+		case "excel":
+			serial, err := strconv.ParseFloat(text, 64)
+			if err != nil || serial < 1 {
+				continue
+			}
+			days := math.Floor(serial)
+			seconds := math.Floor((serial-days)*24*60*60 + 0.5)
+			y, m, d := excelEpoch.AddDate(0, 0, int(days)).Date()
+			return time.Date(y, m, d, 0, 0, int(seconds), 0, p.location), nil
+		default:
+			if date, err := time.ParseInLocation(format, text, p.location); err == nil {
+				return date, nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expires %q: expected one of the formats %s", text, strings.Join(p.formats, ", "))
+}
+
+// today returns midnight at the start of the current day in the parser's
+// location.
+func (p expiresParser) today(now time.Time) time.Time {
+	year, month, day := now.In(p.location).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, p.location)
+}
+
+// expiryDay returns the day that expiry is worked out for: asOf, a
+// "YYYY-MM-DD" date, when it is set and otherwise today by clock.
+func (p expiresParser) expiryDay(asOf string, clock func() time.Time) (time.Time, error) {
+	if asOf == "" {
+		return p.today(clock()), nil
+	}
+	date, err := time.ParseInLocation("2006-01-02", asOf, p.location)
+	if err != nil {
+		return date, fmt.Errorf("Invalid as_of %q: format should be 'YYYY-MM-DD'", asOf)
+	}
+	return date, nil
+}
+
+// formatExpires writes a parsed expires date back out, as a plain date
+// unless it has a time of day.
+func formatExpires(date time.Time) string {
+	year, month, day := date.Date()
+	if date.Equal(time.Date(year, month, day, 0, 0, 0, 0, date.Location())) {
+		return date.Format("2006-01-02")
+	}
+	return date.Format(time.RFC3339)
+}
+
+// validateExpiresFormat is a validation function for the entries of
+// "expires_formats". A layout must include the year, month and day.
+func validateExpiresFormat(v interface{}, k string) (ws []string, errors []error) {
+	format := v.(string)
+	if format == "rfc3339" || format == "excel" {
+		return
+	}
+	reference := time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC)
+	date, err := time.Parse(format, reference.Format(format))
+	if err != nil || date.Year() != 2006 || date.Month() != 1 || date.Day() != 2 {
+		errors = append(errors, fmt.Errorf(
+			"%q: %q must be rfc3339, excel or a Go time layout with a year, month and day such as \"2006-01-02\"", k, format))
+	}
+	return
+}
+
+// validateDate is a validation function for "YYYY-MM-DD" date attributes.
+func validateDate(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := time.Parse("2006-01-02", v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q must be a date in the form YYYY-MM-DD, got %q", k, v.(string)))
+	}
+	return
+}
+
+// validateTimezone is a validation function for the "timezone" attribute.
+func validateTimezone(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := time.LoadLocation(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q: %s", k, err))
+	}
+	return
+}
+
+// period is a length of time that may include calendar years and days, so
+// that "1y" lands on the same date next year.
+type period struct {
+	years    int
+	days     int
+	duration time.Duration
+}
+
+var periodPart = regexp.MustCompile(`^(-?[0-9]+)(y|w|d|h|m|s)`)
+
+// parsePeriod parses a period such as "1y", "2w", "7d", "36h" or "1y30d".
+// "0" is an empty period.
+func parsePeriod(text string) (period, error) {
+	var p period
+	if text == "0" {
+		return p, nil
+	}
+	if text == "" {
+		return p, fmt.Errorf("empty period")
+	}
+
+	for rest := text; rest != ""; {
+		match := periodPart.FindStringSubmatch(rest)
+		if match == nil {
+			return p, fmt.Errorf("invalid period %q: use a number followed by y, w, d, h, m or s", text)
+		}
+		n, err := strconv.Atoi(match[1])
+		if err != nil {
+			return p, fmt.Errorf("invalid period %q: %s", text, err)
+		}
+		switch match[2] {
+		case "y":
+			p.years += n
+		case "w":
+			p.days += 7 * n
+		case "d":
+			p.days += n
+		case "h":
+			p.duration += time.Duration(n) * time.Hour
+		case "m":
+			p.duration += time.Duration(n) * time.Minute
+		case "s":
+			p.duration += time.Duration(n) * time.Second
+		}
+		rest = rest[len(match[0]):]
+	}
+	return p, nil
+}
+
+func (p period) addTo(t time.Time) time.Time {
+	return t.AddDate(p.years, 0, p.days).Add(p.duration)
+}
+
+// validatePeriod is a validation function for period attributes.
+func validatePeriod(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := parsePeriod(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q: %s", k, err))
+	}
+	return
+}
+
+// validatePowerState is a validation function for the power state attributes.
+func validatePowerState(v interface{}, k string) (ws []string, errors []error) {
+	if !isPowerState(v.(string)) {
+		errors = append(errors, fmt.Errorf("%q must be one of %v", k, powerStates))
+	}
+	return
+}
+
+func isPowerState(state string) bool {
+	for _, s := range powerStates {
+		if s == state {
+			return true
+		}
+	}
+	return false
+}
+
+// expiryPolicyFromConfig reads the expiry block of the data source, falling
+// back to the defaults for anything not set.
+func expiryPolicyFromConfig(config []interface{}) (expiryPolicy, error) {
+	policy := defaultExpiryPolicy
+	if len(config) == 0 || config[0] == nil {
+		return policy, nil
+	}
+	return policy.override(config[0].(map[string]interface{}))
+}
+
+// override returns a copy of the policy with the non-empty settings in
+// values, keyed by expiry block attribute name, applied.
+func (policy expiryPolicy) override(values map[string]interface{}) (expiryPolicy, error) {
+	var err error
+	for key, value := range values {
+		text, _ := value.(string)
+		if text == "" {
+			continue
+		}
+		switch key {
+		case "default_lifetime":
+			policy.defaultLifetime, err = parsePeriod(text)
+		case "grace_period":
+			policy.gracePeriod, err = parsePeriod(text)
+		case "drop_after":
+			policy.dropAfter, err = parsePeriod(text)
+		case "notice_period":
+			policy.noticePeriod, err = parsePeriod(text)
+		case "expired_power_state":
+			if !isPowerState(text) {
+				err = fmt.Errorf("invalid power state %q, must be one of %v", text, powerStates)
+			}
+			policy.expiredPowerState = text
+		}
+		if err != nil {
+			return policy, fmt.Errorf("%s: %s", key, err)
+		}
+	}
+	return policy, nil
+}
+
+// rowPolicy applies the expiry override columns of a row to policy.
+func rowPolicy(item map[string]interface{}, policy expiryPolicy) (expiryPolicy, error) {
+	extra, _ := item["extra"].(map[string]interface{})
+	values := make(map[string]interface{})
+	for column, key := range expiryColumns {
+		if value, ok := extra[column]; ok {
+			values[key] = value
+		}
+	}
+	return policy.override(values)
+}
+
+// expiryStatus is where a row stands relative to its expires date.
+type expiryStatus struct {
+	keep         bool // still within its drop_after period
+	expired      bool
+	expiringSoon bool // not yet expired but within its notice period
+}
+
+// applyExpiry fills in the expires date, power state and expiry attributes
+// of a row. expires is rewritten as "YYYY-MM-DD", or as an RFC 3339
+// timestamp when it has a time of day, whatever format it was read in.
+func applyExpiry(item map[string]interface{}, policy expiryPolicy, parser expiresParser, today time.Time) (expiryStatus, error) {
+	var status expiryStatus
+	policy, err := rowPolicy(item, policy)
+	if err != nil {
+		return status, err
+	}
+
+	item["power"] = "ignored" // default to ignored - we don't care about existing state as this could interfere
+	// with maintenance of existing machines.
+	var date time.Time
+	if item["expires"] == "" || item["expires"] == nil {
+		// the default lifetime isn't parsed, it needn't be in expires_formats
+		date = policy.defaultLifetime.addTo(today)
+	} else if date, err = parser.parse(fmt.Sprint(item["expires"])); err != nil {
+		return status, err
+	}
+	item["expires"] = formatExpires(date)
+
+	if today.After(policy.gracePeriod.addTo(date)) {
+		item["power"] = policy.expiredPowerState
+	}
+
+	dropDate := policy.dropAfter.addTo(date)
+	status.expired = today.After(date)
+	status.expiringSoon = !status.expired && !policy.noticePeriod.addTo(today).Before(date)
+	item["expired"] = status.expired
+	item["days_until_expiry"] = daysBetween(today, date)
+	item["drop_date"] = formatExpires(dropDate)
+
+	// don't add any machines to the list that are past drop_after; these
+	// should already have been moved in the state file by python.
+	status.keep = today.Before(dropDate)
+	return status, nil
+}
+
+// daysBetween returns the number of calendar days from one date to another,
+// ignoring the time of day and daylight saving changes.
+func daysBetween(from, to time.Time) int {
+	day := func(t time.Time) time.Time {
+		year, month, d := t.Date()
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+	return int(day(to).Sub(day(from)).Hours() / 24)
+}
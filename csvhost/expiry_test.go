@@ -0,0 +1,272 @@
+package csvhost
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+var utcParser = expiresParser{formats: defaultExpiresFormats, location: time.UTC}
+
+func TestParsePeriod(t *testing.T) {
+	start := time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)
+	cases := map[string]time.Time{
+		"0":      start,
+		"1y":     time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC),
+		"2w":     time.Date(2020, 3, 14, 0, 0, 0, 0, time.UTC),
+		"7d":     time.Date(2020, 3, 7, 0, 0, 0, 0, time.UTC),
+		"36h":    time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC),
+		"1y30d":  time.Date(2021, 3, 31, 0, 0, 0, 0, time.UTC),
+		"-1d12h": time.Date(2020, 2, 28, 12, 0, 0, 0, time.UTC),
+	}
+
+	for text, want := range cases {
+		p, err := parsePeriod(text)
+		if err != nil {
+			t.Errorf("%s: %s", text, err)
+			continue
+		}
+		if got := p.addTo(start); !got.Equal(want) {
+			t.Errorf("%s: got %s; want %s", text, got, want)
+		}
+	}
+
+	for _, text := range []string{"", "7", "d", "1 y", "1month"} {
+		if _, err := parsePeriod(text); err == nil {
+			t.Errorf("%q: expected an error", text)
+		}
+	}
+}
+
+func TestApplyExpiry(t *testing.T) {
+	today := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	lab, err := defaultExpiryPolicy.override(map[string]interface{}{
+		"grace_period":        "2d",
+		"expired_power_state": "suspended",
+		"drop_after":          "30d",
+	})
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	cases := []struct {
+		name    string
+		policy  expiryPolicy
+		expires string
+		extra   map[string]interface{}
+		power   string
+		keep    bool
+	}{
+		{"future", defaultExpiryPolicy, "2020-06-11", nil, "ignored", true},
+		{"expires today", defaultExpiryPolicy, "2020-06-10", nil, "ignored", true},
+		{"expired", defaultExpiryPolicy, "2020-06-09", nil, "poweredOff", true},
+		{"dd/mm/yyyy", defaultExpiryPolicy, "09/06/2020", nil, "poweredOff", true},
+		{"six days", defaultExpiryPolicy, "2020-06-04", nil, "poweredOff", true},
+		{"seven days", defaultExpiryPolicy, "2020-06-03", nil, "poweredOff", false},
+		{"in grace", lab, "2020-06-08", nil, "ignored", true},
+		{"past grace", lab, "2020-06-07", nil, "suspended", true},
+		{"lab drop", lab, "2020-05-11", nil, "suspended", false},
+		{"row override", defaultExpiryPolicy, "2020-06-01", map[string]interface{}{"drop_after": "2w"}, "poweredOff", true},
+	}
+
+	for _, tc := range cases {
+		item := map[string]interface{}{"hostname": "web01", "expires": tc.expires, "extra": tc.extra}
+		status, err := applyExpiry(item, tc.policy, utcParser, today)
+		if err != nil {
+			t.Errorf("%s: %s", tc.name, err)
+			continue
+		}
+		if item["power"] != tc.power || status.keep != tc.keep {
+			t.Errorf("%s: got %v, %v; want %v, %v", tc.name, item["power"], status.keep, tc.power, tc.keep)
+		}
+	}
+}
+
+func TestApplyExpiry_defaultLifetime(t *testing.T) {
+	today := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	item := map[string]interface{}{
+		"hostname": "web01",
+		"expires":  "",
+		"extra":    map[string]interface{}{"lifetime": "90d"},
+	}
+
+	if _, err := applyExpiry(item, defaultExpiryPolicy, utcParser, today); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if item["expires"] != "2020-09-08" {
+		t.Fatalf("expires set to %v", item["expires"])
+	}
+
+	item = map[string]interface{}{
+		"hostname": "web01",
+		"expires":  "",
+		"extra":    map[string]interface{}{"expired_power_state": "off"},
+	}
+	if _, err := applyExpiry(item, defaultExpiryPolicy, utcParser, today); err == nil {
+		t.Fatal("expected an error for an invalid power state column")
+	}
+}
+
+func TestApplyExpiry_defaultLifetimeCustomFormats(t *testing.T) {
+	today := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	us := expiresParser{formats: []string{"01/02/2006"}, location: time.UTC}
+	item := map[string]interface{}{"hostname": "web01", "expires": ""}
+
+	if _, err := applyExpiry(item, defaultExpiryPolicy, us, today); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if item["expires"] != "2021-06-10" {
+		t.Fatalf("expires set to %v", item["expires"])
+	}
+}
+
+func TestExpiresParser(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	if err != nil {
+		t.Skipf("no timezone database: %s", err)
+	}
+	parser := expiresParser{formats: defaultExpiresFormats, location: london}
+
+	cases := map[string]time.Time{
+		"2020-06-10":           time.Date(2020, 6, 10, 0, 0, 0, 0, london),
+		"10/06/2020":           time.Date(2020, 6, 10, 0, 0, 0, 0, london),
+		"2020-06-10T17:00:00Z": time.Date(2020, 6, 10, 17, 0, 0, 0, time.UTC),
+		"43992":                time.Date(2020, 6, 10, 0, 0, 0, 0, london),
+		"43992.75":             time.Date(2020, 6, 10, 18, 0, 0, 0, london),
+		" 2020-06-10 ":         time.Date(2020, 6, 10, 0, 0, 0, 0, london),
+	}
+	for text, want := range cases {
+		got, err := parser.parse(text)
+		if err != nil {
+			t.Errorf("%q: %s", text, err)
+			continue
+		}
+		if !got.Equal(want) {
+			t.Errorf("%q: got %s; want %s", text, got, want)
+		}
+	}
+
+	us := expiresParser{formats: []string{"01/02/2006"}, location: time.UTC}
+	got, err := us.parse("06/10/2020")
+	if err != nil || !got.Equal(time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("us format: got %s, %v", got, err)
+	}
+
+	_, err = us.parse("2020-06-10")
+	if err == nil || !strings.Contains(err.Error(), `"2020-06-10"`) {
+		t.Errorf("expected an error naming the value, got %v", err)
+	}
+}
+
+func TestApplyExpiry_normalisesExpires(t *testing.T) {
+	today := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	cases := map[string]string{
+		"09/06/2020":           "2020-06-09",
+		"43991":                "2020-06-09",
+		"2020-06-09T17:00:00Z": "2020-06-09T17:00:00Z",
+	}
+	for expires, want := range cases {
+		item := map[string]interface{}{"hostname": "web01", "expires": expires}
+		if _, err := applyExpiry(item, defaultExpiryPolicy, utcParser, today); err != nil {
+			t.Errorf("%q: %s", expires, err)
+			continue
+		}
+		if item["expires"] != want {
+			t.Errorf("%q: got %v; want %s", expires, item["expires"], want)
+		}
+	}
+}
+
+func TestValidateExpiresFormat(t *testing.T) {
+	for _, format := range []string{"2006-01-02", "01/02/2006", "2 Jan 06", "rfc3339", "excel"} {
+		if _, errs := validateExpiresFormat(format, "expires_formats.0"); len(errs) > 0 {
+			t.Errorf("%q: %s", format, errs[0])
+		}
+	}
+	for _, format := range []string{"YYYY-MM-DD", "01/2006", "15:04"} {
+		if _, errs := validateExpiresFormat(format, "expires_formats.0"); len(errs) == 0 {
+			t.Errorf("%q: expected an error", format)
+		}
+	}
+}
+
+func TestExpiryDay(t *testing.T) {
+	clock := func() time.Time { return time.Date(2020, 6, 10, 23, 30, 0, 0, time.UTC) }
+
+	today, err := utcParser.expiryDay("", clock)
+	if err != nil || !today.Equal(time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("got %s, %v", today, err)
+	}
+
+	// the clock is read in the parser's timezone, where it's already the 11th
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skipf("no timezone database: %s", err)
+	}
+	parser := expiresParser{formats: defaultExpiresFormats, location: tokyo}
+	today, err = parser.expiryDay("", clock)
+	if err != nil || !today.Equal(time.Date(2020, 6, 11, 0, 0, 0, 0, tokyo)) {
+		t.Fatalf("got %s, %v", today, err)
+	}
+
+	if _, err := utcParser.expiryDay("10/06/2020", clock); err == nil {
+		t.Fatal("expected an error for as_of not in YYYY-MM-DD format")
+	}
+}
+
+func TestExpiryDay_dropAfter(t *testing.T) {
+	item := func() map[string]interface{} {
+		return map[string]interface{}{"hostname": "web01", "expires": "2020-06-01"}
+	}
+	cases := map[string]bool{
+		"2020-06-01": true,
+		"2020-06-07": true,
+		"2020-06-08": false,
+		"2020-06-15": false,
+	}
+	for asOf, want := range cases {
+		day, err := utcParser.expiryDay(asOf, time.Now)
+		if err != nil {
+			t.Fatalf("%s: %s", asOf, err)
+		}
+		status, err := applyExpiry(item(), defaultExpiryPolicy, utcParser, day)
+		if err != nil {
+			t.Fatalf("%s: %s", asOf, err)
+		}
+		if status.keep != want {
+			t.Errorf("as_of %s: got keep %v; want %v", asOf, status.keep, want)
+		}
+	}
+}
+
+func TestApplyExpiry_status(t *testing.T) {
+	today := time.Date(2020, 6, 10, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		expires      string
+		expired      bool
+		days         int
+		dropDate     string
+		expiringSoon bool
+	}{
+		{"2020-07-10", false, 30, "2020-07-17", false},
+		{"2020-06-24", false, 14, "2020-07-01", true},
+		{"2020-06-10", false, 0, "2020-06-17", true},
+		{"2020-06-09", true, -1, "2020-06-16", false},
+	}
+
+	for _, tc := range cases {
+		item := map[string]interface{}{"hostname": "web01", "expires": tc.expires}
+		status, err := applyExpiry(item, defaultExpiryPolicy, utcParser, today)
+		if err != nil {
+			t.Errorf("%s: %s", tc.expires, err)
+			continue
+		}
+		if item["expired"] != tc.expired || item["days_until_expiry"] != tc.days || item["drop_date"] != tc.dropDate {
+			t.Errorf("%s: got %v, %v, %v; want %v, %v, %v", tc.expires,
+				item["expired"], item["days_until_expiry"], item["drop_date"], tc.expired, tc.days, tc.dropDate)
+		}
+		if status.expired != tc.expired || status.expiringSoon != tc.expiringSoon {
+			t.Errorf("%s: got status %+v", tc.expires, status)
+		}
+	}
+}
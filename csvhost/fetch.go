@@ -0,0 +1,233 @@
+package csvhost
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"github.com/hashicorp/go-getter"
+	"hash"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// sourceCache is where the last good copy of remote sources is kept.
+type sourceCache struct {
+	dir    string
+	maxAge *period // how old a copy may be used; nil never uses one
+	now    time.Time
+}
+
+// sourceCacheFromConfig reads the cache_dir and cache_max_age attributes.
+func sourceCacheFromConfig(dir, maxAge string, now time.Time) (sourceCache, error) {
+	cache := sourceCache{dir: dir, now: now}
+	if maxAge == "" {
+		return cache, nil
+	}
+	if dir == "" {
+		return cache, fmt.Errorf("cache_max_age needs a cache_dir")
+	}
+	p, err := parsePeriod(maxAge)
+	if err != nil {
+		return cache, fmt.Errorf("cache_max_age: %s", err)
+	}
+	cache.maxAge = &p
+	return cache, nil
+}
+
+// isRemoteSource reports whether source is a go-getter URL such as
+// "https://...", "s3::https://..." or "git::ssh://...//inventory.csv?ref=v1"
+// rather than a local path.
+func isRemoteSource(source string) bool {
+	return strings.Contains(source, "::") || strings.Contains(source, "://")
+}
+
+// fetchSource returns the contents of an inventory and the name of the file
+// they came from, which is used to pick a reader when no format is given.
+//
+// Remote sources are downloaded with go-getter every time. When cache.dir is
+// set the last good copy is kept there, and it is used if the source can't
+// be reached only when it is no older than cache.maxAge. When checksum is
+// set the contents must match it.
+func fetchSource(source string, cache sourceCache, checksum string) ([]byte, string, error) {
+	verify := func(data []byte) error {
+		if checksum == "" {
+			return nil
+		}
+		if err := verifyChecksum(data, checksum); err != nil {
+			return fmt.Errorf("%q: %s", source, err)
+		}
+		return nil
+	}
+
+	if !isRemoteSource(source) {
+		data, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, source, verify(data)
+	}
+
+	filename := sourceFilename(source)
+	cached := ""
+	if cache.dir != "" {
+		key := sha256.Sum256([]byte(source))
+		cached = filepath.Join(cache.dir, hex.EncodeToString(key[:8]), filename)
+	}
+
+	data, err := downloadSource(source, filename)
+	if err != nil {
+		if cached == "" || cache.maxAge == nil {
+			return nil, "", err
+		}
+		info, statErr := os.Stat(cached)
+		if statErr != nil {
+			return nil, "", err
+		}
+		if cache.now.After(cache.maxAge.addTo(info.ModTime())) {
+			return nil, "", fmt.Errorf("%s; the cached copy from %s is older than cache_max_age",
+				err, info.ModTime().Format(time.RFC3339))
+		}
+		data, cacheErr := ioutil.ReadFile(cached)
+		if cacheErr != nil {
+			return nil, "", err
+		}
+		log.Printf("[WARN] Using cached copy %s of %s from %s: %s", cached, source, info.ModTime().Format(time.RFC3339), err)
+		return data, cached, verify(data)
+	}
+
+	if err := verify(data); err != nil {
+		return nil, "", err
+	}
+	if cached != "" {
+		if err := writeCache(cached, data); err != nil {
+			log.Printf("[WARN] Failed to cache %s: %s", source, err)
+		}
+	}
+	return data, filename, nil
+}
+
+// downloadSource fetches source into a temporary directory and returns its
+// contents. A "//path/to/file" suffix selects a file from a downloaded
+// directory, such as a git repository.
+func downloadSource(source, filename string) ([]byte, error) {
+	staging, err := ioutil.TempDir("", "csvhost")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+
+	pwd, err := os.Getwd()
+	if err != nil {
+		return nil, err
+	}
+
+	client := &getter.Client{
+		Src:  source,
+		Dst:  filepath.Join(staging, filename),
+		Pwd:  pwd,
+		Mode: getter.ClientModeFile,
+	}
+	file := client.Dst
+
+	src, subDir := getter.SourceDirSubdir(source)
+	if subDir != "" {
+		client.Src = src
+		client.Dst = filepath.Join(staging, "root")
+		client.Mode = getter.ClientModeDir
+		file = filepath.Join(client.Dst, filepath.FromSlash(subDir))
+	}
+
+	if err := client.Get(); err != nil {
+		return nil, fmt.Errorf("failed to fetch %q: %s", source, err)
+	}
+	return ioutil.ReadFile(file)
+}
+
+// sourceFilename returns the base name of the file a source refers to.
+func sourceFilename(source string) string {
+	src, subDir := getter.SourceDirSubdir(source)
+	if subDir != "" {
+		return path.Base(subDir)
+	}
+	if idx := strings.Index(src, "::"); idx > -1 {
+		src = src[idx+2:]
+	}
+	if u, err := url.Parse(src); err == nil && path.Base(u.Path) != "/" && path.Base(u.Path) != "." {
+		return path.Base(u.Path)
+	}
+	return "inventory"
+}
+
+func writeCache(cached string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(cached), 0755); err != nil {
+		return err
+	}
+	// write then rename so a reader never sees a partial file
+	tmp := cached + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, cached)
+}
+
+// verifyChecksum checks data against a checksum of the form "type:value",
+// where type is md5, sha1, sha256 or sha512.
+func verifyChecksum(data []byte, checksum string) error {
+	h, want, err := parseChecksum(checksum)
+	if err != nil {
+		return err
+	}
+	h.Write(data)
+	if got := h.Sum(nil); !bytes.Equal(got, want) {
+		return fmt.Errorf("checksum mismatch: expected %x, got %x", want, got)
+	}
+	return nil
+}
+
+func parseChecksum(checksum string) (hash.Hash, []byte, error) {
+	idx := strings.Index(checksum, ":")
+	if idx < 0 {
+		return nil, nil, fmt.Errorf("checksum %q must be of the form type:value", checksum)
+	}
+
+	var h hash.Hash
+	switch checksum[:idx] {
+	case "md5":
+		h = md5.New()
+	case "sha1":
+		h = sha1.New()
+	case "sha256":
+		h = sha256.New()
+	case "sha512":
+		h = sha512.New()
+	default:
+		return nil, nil, fmt.Errorf("unsupported checksum type %q", checksum[:idx])
+	}
+
+	value, err := hex.DecodeString(checksum[idx+1:])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid checksum value: %s", err)
+	}
+	if len(value) != h.Size() {
+		return nil, nil, fmt.Errorf("%s checksum must be %d bytes, got %d", checksum[:idx], h.Size(), len(value))
+	}
+	return h, value, nil
+}
+
+// validateChecksum is a validation function for the "checksum" attribute.
+func validateChecksum(v interface{}, k string) (ws []string, errors []error) {
+	if _, _, err := parseChecksum(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q: %s", k, err))
+	}
+	return
+}
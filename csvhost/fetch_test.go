@@ -0,0 +1,124 @@
+package csvhost
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testInventory = `hostname,address,gateway,subnet,cpu,memory,vapp,network,template
+web01,10.0.0.10,10.0.0.1,24,2,4096,web,vlan10,small
+`
+
+func TestFetchSource_http(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/inventory/hosts.csv" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, testInventory)
+	}))
+
+	cacheDir, err := ioutil.TempDir("", "csvhost-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	source := server.URL + "/inventory/hosts.csv"
+	checksum := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(testInventory)))
+	now := time.Now()
+	day, _ := parsePeriod("1d")
+	cache := sourceCache{dir: cacheDir, now: now}
+
+	data, filename, err := fetchSource(source, cache, checksum)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != testInventory || filename != "hosts.csv" {
+		t.Fatalf("unexpected result %q from %q", data, filename)
+	}
+
+	if _, _, err := fetchSource(source, sourceCache{}, "sha256:"+strings.Repeat("00", 32)); err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected a checksum mismatch, got %v", err)
+	}
+
+	// the cached copy is only used once the server has gone away when
+	// cache_max_age allows it
+	server.Close()
+	if _, _, err := fetchSource(source, cache, checksum); err == nil {
+		t.Fatal("expected an error without cache_max_age")
+	}
+
+	cache.maxAge = &day
+	data, filename, err = fetchSource(source, cache, checksum)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if string(data) != testInventory || filepath.Base(filename) != "hosts.csv" {
+		t.Fatalf("unexpected cached result %q from %q", data, filename)
+	}
+
+	cache.now = now.Add(25 * time.Hour)
+	if _, _, err := fetchSource(source, cache, checksum); err == nil || !strings.Contains(err.Error(), "older than cache_max_age") {
+		t.Fatalf("expected an error for a stale cache, got %v", err)
+	}
+
+	if _, _, err := fetchSource(source, sourceCache{}, ""); err == nil {
+		t.Fatal("expected an error without a cache")
+	}
+}
+
+func TestSourceCacheFromConfig(t *testing.T) {
+	if _, err := sourceCacheFromConfig("", "1d", time.Now()); err == nil {
+		t.Fatal("expected an error for cache_max_age without cache_dir")
+	}
+	cache, err := sourceCacheFromConfig("/tmp/cache", "", time.Now())
+	if err != nil || cache.maxAge != nil {
+		t.Fatalf("got %+v, %v", cache, err)
+	}
+}
+
+func TestFetchSource_local(t *testing.T) {
+	f, err := ioutil.TempFile("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(testInventory)
+	f.Close()
+
+	data, filename, err := fetchSource(f.Name(), sourceCache{}, "")
+	if err != nil || string(data) != testInventory || filename != f.Name() {
+		t.Fatalf("unexpected result %q, %q, %v", data, filename, err)
+	}
+}
+
+func TestSourceFilename(t *testing.T) {
+	cases := map[string]string{
+		"https://example.com/inventory/hosts.csv?archive=false":         "hosts.csv",
+		"s3::https://s3.amazonaws.com/bucket/hosts.xlsx":                "hosts.xlsx",
+		"git::https://example.com/inventory.git//data/hosts.yml?ref=v1": "hosts.yml",
+		"https://example.com/": "inventory",
+	}
+	for source, want := range cases {
+		if got := sourceFilename(source); got != want {
+			t.Errorf("%s: got %q; want %q", source, got, want)
+		}
+	}
+}
+
+func TestParseChecksum(t *testing.T) {
+	for _, checksum := range []string{"sha256", "crc32:00", "md5:zz", "sha1:00"} {
+		if _, _, err := parseChecksum(checksum); err == nil {
+			t.Errorf("%s: expected an error", checksum)
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package csvhost
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A filter expression selects CSV rows, e.g.
+//
+//	vapp == "web" and cpu >= 4 and not hostname matches "^db"
+//	network in ("vlan10", "vlan20") or (template startswith "large" and memory > 8192)
+//
+// Comparisons are between a column name and a literal. ==, !=, <, <=, > and
+// >= compare numerically when both sides are numbers and as strings
+// otherwise; startswith, endswith, contains and matches (a regular
+// expression) always compare as strings. Expressions may be combined with
+// and, or, not and parentheses.
+type filterExpr interface {
+	eval(row map[string]interface{}) (bool, error)
+}
+
+type andExpr struct {
+	left, right filterExpr
+}
+
+func (e *andExpr) eval(row map[string]interface{}) (bool, error) {
+	ok, err := e.left.eval(row)
+	if err != nil || !ok {
+		return false, err
+	}
+	return e.right.eval(row)
+}
+
+type orExpr struct {
+	left, right filterExpr
+}
+
+func (e *orExpr) eval(row map[string]interface{}) (bool, error) {
+	ok, err := e.left.eval(row)
+	if err != nil || ok {
+		return ok, err
+	}
+	return e.right.eval(row)
+}
+
+type notExpr struct {
+	expr filterExpr
+}
+
+func (e *notExpr) eval(row map[string]interface{}) (bool, error) {
+	ok, err := e.expr.eval(row)
+	return !ok, err
+}
+
+type compareExpr struct {
+	column string
+	op     string
+	values []interface{}
+	regexp *regexp.Regexp
+}
+
+func (e *compareExpr) eval(row map[string]interface{}) (bool, error) {
+	value, err := filterColumn(row, e.column)
+	if err != nil {
+		return false, err
+	}
+
+	switch e.op {
+	case "in":
+		for _, v := range e.values {
+			if filterEqual(value, v) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "==":
+		return filterEqual(value, e.values[0]), nil
+	case "!=":
+		return !filterEqual(value, e.values[0]), nil
+	case "startswith":
+		return strings.HasPrefix(fmt.Sprint(value), fmt.Sprint(e.values[0])), nil
+	case "endswith":
+		return strings.HasSuffix(fmt.Sprint(value), fmt.Sprint(e.values[0])), nil
+	case "contains":
+		return strings.Contains(fmt.Sprint(value), fmt.Sprint(e.values[0])), nil
+	case "matches":
+		return e.regexp.MatchString(fmt.Sprint(value)), nil
+	}
+
+	// ordering comparisons
+	var cmp int
+	if n, ok := e.values[0].(float64); ok {
+		v, ok := filterNumber(value)
+		if !ok {
+			return false, fmt.Errorf("column %q value %q is not a number", e.column, fmt.Sprint(value))
+		}
+		switch {
+		case v < n:
+			cmp = -1
+		case v > n:
+			cmp = 1
+		}
+	} else {
+		cmp = strings.Compare(fmt.Sprint(value), e.values[0].(string))
+	}
+
+	switch e.op {
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+// filterColumn looks a column up in a row, falling back to the columns
+// passed through in "extra".
+func filterColumn(row map[string]interface{}, column string) (interface{}, error) {
+	if isKnownColumn(column) {
+		return row[column], nil
+	}
+	if extra, ok := row["extra"].(map[string]interface{}); ok {
+		if value, ok := extra[column]; ok {
+			return value, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown column %q", column)
+}
+
+func filterNumber(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func filterEqual(value, literal interface{}) bool {
+	if n, ok := literal.(float64); ok {
+		if v, ok := filterNumber(value); ok {
+			return v == n
+		}
+	}
+	return fmt.Sprint(value) == fmt.Sprint(literal)
+}
+
+// validateFilter is a validation function for the "filter" attribute.
+//
+// Column names can only be checked once the source has been read, by
+// checkFilterColumns.
+func validateFilter(v interface{}, k string) (ws []string, errors []error) {
+	if _, err := parseFilter(v.(string)); err != nil {
+		errors = append(errors, fmt.Errorf("%q: %s", k, err))
+	}
+	return
+}
+
+// filterColumns returns the columns an expression refers to.
+func filterColumns(expr filterExpr) []string {
+	switch e := expr.(type) {
+	case *andExpr:
+		return append(filterColumns(e.left), filterColumns(e.right)...)
+	case *orExpr:
+		return append(filterColumns(e.left), filterColumns(e.right)...)
+	case *notExpr:
+		return filterColumns(e.expr)
+	case *compareExpr:
+		return []string{e.column}
+	}
+	return nil
+}
+
+// checkFilterColumns checks that every column a filter or query refers to is
+// a known column or one of columns, the columns of the source, before any
+// row is evaluated. Otherwise a misspelt column would only be found when a
+// row reaches it, or never.
+func checkFilterColumns(expr filterExpr, query map[string]interface{}, columns []string) error {
+	inSource := make(map[string]bool, len(columns))
+	for _, c := range columns {
+		inSource[c] = true
+	}
+	check := func(name string) error {
+		if !isKnownColumn(name) && !inSource[name] {
+			return fmt.Errorf("unknown column %q", name)
+		}
+		return nil
+	}
+
+	for _, name := range filterColumns(expr) {
+		if err := check(name); err != nil {
+			return fmt.Errorf("Invalid filter: %s", err)
+		}
+	}
+	for name := range query {
+		if err := check(name); err != nil {
+			return fmt.Errorf("Invalid query: %s", err)
+		}
+	}
+	return nil
+}
+
+type filterToken struct {
+	kind string // "ident", "string", "number", "op" or "eof"
+	text string
+	pos  int
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+// parseFilter parses a filter expression. An empty expression matches every
+// row and is returned as nil.
+func parseFilter(text string) (filterExpr, error) {
+	tokens, err := lexFilter(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, nil
+	}
+
+	p := &filterParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, fmt.Errorf("unexpected %q at position %d", t.text, t.pos)
+	}
+	return expr, nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.tokens[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+// keyword reports whether the next token is the given keyword or operator
+// and consumes it if so.
+func (p *filterParser) keyword(word string) bool {
+	t := p.peek()
+	if (t.kind == "ident" || t.kind == "op") && strings.ToLower(t.text) == word {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(word string) error {
+	if !p.keyword(word) {
+		t := p.peek()
+		return fmt.Errorf("expected %q at position %d, found %q", word, t.pos, t.text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterExpr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andExpr{left, right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterExpr, error) {
+	if p.keyword("not") {
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notExpr{expr}, nil
+	}
+	if p.keyword("(") {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return expr, p.expect(")")
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseComparison() (filterExpr, error) {
+	column := p.next()
+	if column.kind != "ident" || isFilterKeyword(column.text) {
+		return nil, fmt.Errorf("expected a column name at position %d, found %q", column.pos, column.text)
+	}
+	name := strings.ToLower(column.text)
+
+	negate := p.keyword("not")
+	if p.keyword("in") {
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		var expr filterExpr = &compareExpr{column: name, op: "in", values: values}
+		if negate {
+			expr = &notExpr{expr}
+		}
+		return expr, nil
+	}
+	if negate {
+		t := p.peek()
+		return nil, fmt.Errorf("expected \"in\" at position %d, found %q", t.pos, t.text)
+	}
+
+	op := p.next()
+	switch strings.ToLower(op.text) {
+	case "==", "!=", "<", "<=", ">", ">=", "startswith", "endswith", "contains", "matches":
+	default:
+		return nil, fmt.Errorf("expected an operator at position %d, found %q", op.pos, op.text)
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	expr := &compareExpr{column: name, op: strings.ToLower(op.text), values: []interface{}{value}}
+	if expr.op == "matches" {
+		if expr.regexp, err = regexp.Compile(fmt.Sprint(value)); err != nil {
+			return nil, fmt.Errorf("invalid regular expression at position %d: %s", op.pos, err)
+		}
+	}
+	return expr, nil
+}
+
+func (p *filterParser) parseList() ([]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	values := make([]interface{}, 0)
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		if !p.keyword(",") {
+			break
+		}
+	}
+	return values, p.expect(")")
+}
+
+func (p *filterParser) parseValue() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case "string":
+		return t.text, nil
+	case "number":
+		n, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at position %d", t.text, t.pos)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("expected a value at position %d, found %q", t.pos, t.text)
+}
+
+func isFilterKeyword(word string) bool {
+	switch strings.ToLower(word) {
+	case "and", "or", "not", "in", "startswith", "endswith", "contains", "matches":
+		return true
+	}
+	return false
+}
+
+func lexFilter(text string) ([]filterToken, error) {
+	tokens := make([]filterToken, 0)
+	runes := []rune(text)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '"' || r == '\'':
+			start := i
+			value := make([]rune, 0)
+			for i++; i < len(runes) && runes[i] != r; i++ {
+				if runes[i] == '\\' && i+1 < len(runes) {
+					i++
+				}
+				value = append(value, runes[i])
+			}
+			if i >= len(runes) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, filterToken{"string", string(value), start})
+		case unicode.IsDigit(r) || (r == '-' && i+1 < len(runes) && unicode.IsDigit(runes[i+1])):
+			start := i
+			for i++; i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.'); i++ {
+			}
+			tokens = append(tokens, filterToken{"number", string(runes[start:i]), start})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i++; i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '.'); i++ {
+			}
+			tokens = append(tokens, filterToken{"ident", string(runes[start:i]), start})
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, filterToken{"op", string(r), i})
+			i++
+		case strings.ContainsRune("=!<>", r):
+			start := i
+			i++
+			if i < len(runes) && runes[i] == '=' {
+				i++
+			}
+			op := string(runes[start:i])
+			if op == "=" || op == "!" {
+				return nil, fmt.Errorf("unknown operator %q at position %d", op, start)
+			}
+			tokens = append(tokens, filterToken{"op", op, start})
+		default:
+			return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+		}
+	}
+	return append(tokens, filterToken{"eof", "end of filter", len(runes)}), nil
+}
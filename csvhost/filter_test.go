@@ -0,0 +1,136 @@
+package csvhost
+
+import (
+	"strings"
+	"testing"
+)
+
+func testFilterRow() map[string]interface{} {
+	return map[string]interface{}{
+		"hostname": "web01.example.com",
+		"address":  "10.0.0.10",
+		"cpu":      4,
+		"memory":   float64(8192),
+		"vapp":     "web",
+		"network":  "vlan10",
+		"template": "large-centos",
+		"expires":  "2030-01-01",
+		"extra": map[string]interface{}{
+			"owner": "ops",
+		},
+	}
+}
+
+func TestFilter(t *testing.T) {
+	cases := []struct {
+		filter string
+		match  bool
+	}{
+		{`vapp == "web"`, true},
+		{`vapp != "web"`, false},
+		{`cpu >= 4`, true},
+		{`cpu > 4`, false},
+		{`memory < 16384 and cpu <= 4`, true},
+		{`hostname endswith ".example.com"`, true},
+		{`hostname startswith "db"`, false},
+		{`template contains "centos"`, true},
+		{`hostname matches "^web[0-9]+\\."`, true},
+		{`network in ("vlan10", "vlan20")`, true},
+		{`network not in ('vlan10')`, false},
+		{`cpu in (2, 4, 8)`, true},
+		{`not vapp == "web" or owner == "ops"`, true},
+		{`not (vapp == "web" or owner == "ops")`, false},
+		{`expires < "2031-01-01"`, true},
+		{`VAPP == "web" AND cpu >= 2`, true},
+	}
+
+	for _, tc := range cases {
+		expr, err := parseFilter(tc.filter)
+		if err != nil {
+			t.Errorf("%s: %s", tc.filter, err)
+			continue
+		}
+		match, err := expr.eval(testFilterRow())
+		if err != nil {
+			t.Errorf("%s: %s", tc.filter, err)
+			continue
+		}
+		if match != tc.match {
+			t.Errorf("%s: got %v; want %v", tc.filter, match, tc.match)
+		}
+	}
+}
+
+func TestFilter_empty(t *testing.T) {
+	expr, err := parseFilter("   ")
+	if err != nil || expr != nil {
+		t.Fatalf("expected no filter, got %#v, %v", expr, err)
+	}
+}
+
+func TestFilter_parseErrors(t *testing.T) {
+	cases := []string{
+		`vapp ==`,
+		`vapp = "web"`,
+		`vapp == "web" and`,
+		`(vapp == "web"`,
+		`vapp == "web`,
+		`cpu between 1`,
+		`hostname matches "("`,
+		`network not == "a"`,
+	}
+
+	for _, filter := range cases {
+		if _, err := parseFilter(filter); err == nil {
+			t.Errorf("%s: expected a parse error", filter)
+		}
+	}
+}
+
+func TestFilter_evalErrors(t *testing.T) {
+	expr, err := parseFilter(`colour == "red"`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := expr.eval(testFilterRow()); err == nil || !strings.Contains(err.Error(), `unknown column "colour"`) {
+		t.Fatalf("expected an unknown column error, got %v", err)
+	}
+
+	expr, err = parseFilter(`vapp > 3`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if _, err := expr.eval(testFilterRow()); err == nil {
+		t.Fatal("expected an error comparing a string column with a number")
+	}
+}
+
+func TestCheckFilterColumns(t *testing.T) {
+	header := []string{"hostname", "address", "owner"}
+
+	// the unknown column would never be evaluated: the or short-circuits
+	expr, err := parseFilter(`vapp == "web" or colour == "red"`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := checkFilterColumns(expr, nil, header); err == nil || !strings.Contains(err.Error(), `Invalid filter: unknown column "colour"`) {
+		t.Fatalf("expected an unknown column error, got %v", err)
+	}
+	// nor would it be for a source without rows
+	if err := checkFilterColumns(expr, nil, nil); err == nil {
+		t.Fatal("expected an unknown column error for an empty source")
+	}
+
+	query := map[string]interface{}{"vapp": "web", "colour": "red"}
+	if err := checkFilterColumns(nil, query, header); err == nil || !strings.Contains(err.Error(), `Invalid query: unknown column "colour"`) {
+		t.Fatalf("expected an unknown column error, got %v", err)
+	}
+
+	expr, err = parseFilter(`owner == "ops" and cpu > 1`)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if err := checkFilterColumns(expr, map[string]interface{}{"owner": "ops"}, header); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
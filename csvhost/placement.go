@@ -0,0 +1,136 @@
+package csvhost
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// placementStrategy picks the datastore for the disks of a host that doesn't
+// have a VM yet. position is the index of the row among all the rows
+// selected, after sort_by and before offset and limit. datastores is never
+// empty.
+type placementStrategy interface {
+	place(item map[string]interface{}, position int, datastores []datastore) (string, error)
+}
+
+// placementStrategies are the values of the "placement" attribute.
+var placementStrategies = map[string]func() placementStrategy{
+	"random":          func() placementStrategy { return &randomPlacement{} },
+	"most_free_space": func() placementStrategy { return &freeSpacePlacement{} },
+	"round_robin":     func() placementStrategy { return &roundRobinPlacement{} },
+	"hash":            func() placementStrategy { return &hashPlacement{} },
+	"column":          func() placementStrategy { return &columnPlacement{column: "lun"} },
+}
+
+// getPlacementStrategy returns the strategy for the "placement" attribute.
+func getPlacementStrategy(name string) (placementStrategy, error) {
+	strategy, ok := placementStrategies[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown placement %q", name)
+	}
+	return strategy(), nil
+}
+
+// validatePlacement is a validation function for the "placement" attribute.
+func validatePlacement(v interface{}, k string) (ws []string, errors []error) {
+	if _, ok := placementStrategies[v.(string)]; !ok {
+		names := make([]string, 0, len(placementStrategies))
+		for name := range placementStrategies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		errors = append(errors, fmt.Errorf("%q must be one of %s", k, strings.Join(names, ", ")))
+	}
+	return
+}
+
+// randomPlacement picks any datastore. A host without a VM may be given a
+// different datastore on every plan, so downstream resources never settle;
+// hash is the stable alternative.
+type randomPlacement struct{}
+
+func (p *randomPlacement) place(item map[string]interface{}, position int, datastores []datastore) (string, error) {
+	return datastores[rand.Intn(len(datastores))].name, nil
+}
+
+// freeSpacePlacement picks the datastore with the most free space, breaking
+// ties by name.
+type freeSpacePlacement struct{}
+
+func (p *freeSpacePlacement) place(item map[string]interface{}, position int, datastores []datastore) (string, error) {
+	best := datastores[0]
+	for _, ds := range datastores[1:] {
+		if ds.freeSpace > best.freeSpace || (ds.freeSpace == best.freeSpace && ds.name < best.name) {
+			best = ds
+		}
+	}
+	return best.name, nil
+}
+
+// roundRobinPlacement spreads new hosts across the datastores, in name
+// order, by their position among the selected rows. A page of the rows gets
+// the same datastores as it would reading every row, but a host moves when
+// rows before it are added or removed; hash is the stable alternative.
+type roundRobinPlacement struct{}
+
+func (p *roundRobinPlacement) place(item map[string]interface{}, position int, datastores []datastore) (string, error) {
+	names := datastoreNames(datastores)
+	return names[position%len(names)], nil
+}
+
+// hashPlacement picks a datastore from a hash of the hostname, so a host that
+// doesn't have a VM yet is given the same datastore on every plan. Each
+// datastore is scored by hashing it with the hostname and the highest score
+// wins: adding a datastore only moves the hosts that it now wins, and
+// removing one only moves the hosts that were on it.
+type hashPlacement struct{}
+
+func (p *hashPlacement) place(item map[string]interface{}, position int, datastores []datastore) (string, error) {
+	hostname := fmt.Sprint(item["hostname"])
+	best, bestScore := "", uint64(0)
+	for _, ds := range datastores {
+		h := fnv.New64a()
+		h.Write([]byte(hostname))
+		h.Write([]byte{0})
+		h.Write([]byte(ds.name))
+		score := h.Sum64()
+		if best == "" || score > bestScore || (score == bestScore && ds.name < best) {
+			best, bestScore = ds.name, score
+		}
+	}
+	return best, nil
+}
+
+// columnPlacement uses the datastore named in a column of the row.
+type columnPlacement struct {
+	column string
+}
+
+func (p *columnPlacement) place(item map[string]interface{}, position int, datastores []datastore) (string, error) {
+	value, err := filterColumn(item, p.column)
+	if err != nil {
+		return "", fmt.Errorf("placement %q needs a %q column", "column", p.column)
+	}
+	name := strings.TrimSpace(fmt.Sprint(value))
+	if name == "" {
+		return "", fmt.Errorf("%q column is empty", p.column)
+	}
+	for _, ds := range datastores {
+		if ds.name == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("%q column names datastore %q, which clusterPrefix and datastore_filter don't allow", p.column, name)
+}
+
+func datastoreNames(datastores []datastore) []string {
+	names := make([]string, len(datastores))
+	for i, ds := range datastores {
+		names[i] = ds.name
+	}
+	sort.Strings(names)
+	return names
+}
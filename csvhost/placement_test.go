@@ -0,0 +1,96 @@
+package csvhost
+
+import (
+	"fmt"
+	"testing"
+)
+
+var testDatastores = []datastore{
+	{name: "Odd_ds3", freeSpace: 500},
+	{name: "Odd_ds1", freeSpace: 900},
+	{name: "Odd_ds2", freeSpace: 900},
+}
+
+func testPlace(t *testing.T, strategy placementStrategy, hostname string) string {
+	name, err := strategy.place(map[string]interface{}{"hostname": hostname}, 0, testDatastores)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	return name
+}
+
+func TestPlacement_mostFreeSpace(t *testing.T) {
+	if name := testPlace(t, &freeSpacePlacement{}, "web01"); name != "Odd_ds1" {
+		t.Fatalf("got %s", name)
+	}
+}
+
+func TestPlacement_roundRobin(t *testing.T) {
+	strategy := &roundRobinPlacement{}
+	want := []string{"Odd_ds1", "Odd_ds2", "Odd_ds3", "Odd_ds1"}
+	for position, host := range []string{"web01", "web02", "web03", "web04"} {
+		name, err := strategy.place(map[string]interface{}{"hostname": host}, position, testDatastores)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if name != want[position] {
+			t.Fatalf("%s at %d: got %s; want %s", host, position, name, want[position])
+		}
+	}
+}
+
+func TestPlacement_hash(t *testing.T) {
+	first := testPlace(t, &hashPlacement{}, "web01")
+	for i := 0; i < 10; i++ {
+		if name := testPlace(t, &hashPlacement{}, "web01"); name != first {
+			t.Fatalf("got %s then %s", first, name)
+		}
+	}
+
+	// the order vCenter lists datastores in doesn't matter
+	reversed := []datastore{testDatastores[2], testDatastores[1], testDatastores[0]}
+	name, err := (&hashPlacement{}).place(map[string]interface{}{"hostname": "web01"}, 0, reversed)
+	if err != nil || name != first {
+		t.Fatalf("got %s, %v; want %s", name, err, first)
+	}
+}
+
+func TestPlacement_hashAddDatastore(t *testing.T) {
+	grown := append([]datastore{{name: "Odd_ds4"}}, testDatastores...)
+	used := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		item := map[string]interface{}{"hostname": fmt.Sprintf("web%03d", i)}
+		before, _ := (&hashPlacement{}).place(item, 0, testDatastores)
+		after, _ := (&hashPlacement{}).place(item, 0, grown)
+		if after != before && after != "Odd_ds4" {
+			t.Fatalf("%s moved from %s to %s", item["hostname"], before, after)
+		}
+		used[after] = true
+	}
+	if len(used) != len(grown) {
+		t.Fatalf("hosts were only placed on %v", used)
+	}
+}
+
+func TestPlacement_column(t *testing.T) {
+	strategy := &columnPlacement{column: "lun"}
+	item := map[string]interface{}{
+		"hostname": "web01",
+		"extra":    map[string]interface{}{"lun": "Odd_ds2"},
+	}
+	if name, err := strategy.place(item, 0, testDatastores); err != nil || name != "Odd_ds2" {
+		t.Fatalf("got %s, %v", name, err)
+	}
+
+	for _, lun := range []string{"", "Even_ds1"} {
+		item["extra"] = map[string]interface{}{"lun": lun}
+		if _, err := strategy.place(item, 0, testDatastores); err == nil {
+			t.Errorf("%q: expected an error", lun)
+		}
+	}
+
+	delete(item, "extra")
+	if _, err := strategy.place(item, 0, testDatastores); err == nil {
+		t.Error("expected an error for a missing column")
+	}
+}
@@ -1,15 +1,85 @@
 package csvhost
 
 import (
+	"log"
+
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 )
 
 func Provider() terraform.ResourceProvider {
-	return &schema.Provider{
+	provider := &schema.Provider{
+		Schema: map[string]*schema.Schema{
+			"vsphere_server": &schema.Schema{
+				Type:        schema.TypeString,
+				Required:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VSPHERE_SERVER", nil),
+				Description: "The vCenter server hostname used to look up VMs and datastores.",
+			},
+
+			"user": &schema.Schema{
+				Type:        schema.TypeString,
+				Required:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VSPHERE_USER", nil),
+				Description: "The user name for vCenter API operations.",
+			},
+
+			"password": &schema.Schema{
+				Type:        schema.TypeString,
+				Required:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("VSPHERE_PASSWORD", nil),
+				Description: "The user password for vCenter API operations.",
+			},
+
+			"allow_unverified_ssl": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VSPHERE_ALLOW_UNVERIFIED_SSL", false),
+				Description: "If set, the vCenter certificate is not verified.",
+			},
+
+			"ca_file": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("VSPHERE_CA_FILE", ""),
+				Description: "Path to a PEM encoded CA bundle used to verify the vCenter certificate.",
+			},
+		},
 		DataSourcesMap: map[string]*schema.Resource{
-			"csvhost": dataSource(),
+			"csvhost":       dataSource(),
+			"csvhost_drift": driftDataSource(),
 		},
 		ResourcesMap: map[string]*schema.Resource{},
 	}
+
+	provider.ConfigureFunc = func(d *schema.ResourceData) (interface{}, error) {
+		client, err := providerConfigure(d)
+		if err != nil {
+			return nil, err
+		}
+
+		// end the vCenter session when Terraform stops the provider; at
+		// the end of a normal run it is ended by the last read instead
+		go func() {
+			<-provider.StopContext().Done()
+			if err := client.stop(); err != nil {
+				log.Printf("[WARN] %s", err)
+			}
+		}()
+		return client, nil
+	}
+	return provider
+}
+
+func providerConfigure(d *schema.ResourceData) (*Client, error) {
+	config := Config{
+		Server:             d.Get("vsphere_server").(string),
+		User:               d.Get("user").(string),
+		Password:           d.Get("password").(string),
+		AllowUnverifiedSSL: d.Get("allow_unverified_ssl").(bool),
+		CAFile:             d.Get("ca_file").(string),
+	}
+
+	return config.Client()
 }
@@ -0,0 +1,214 @@
+package csvhost
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v2"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// rawRow is a single inventory entry as read from a source, before its
+// values are validated.
+type rawRow struct {
+	where  string // position in the source, e.g. "line 3"
+	values map[string]string
+}
+
+// sourceReader reads a host inventory in one file format. All formats
+// produce the same rows so filtering and enrichment don't depend on it.
+type sourceReader interface {
+	// read returns the column names found in data and its rows. columns,
+	// when not empty, overrides the column names of tabular formats.
+	read(data []byte, columns []string) ([]string, []rawRow, error)
+}
+
+var sourceFormats = map[string]func() sourceReader{
+	"csv":  func() sourceReader { return &csvReader{comma: ','} },
+	"tsv":  func() sourceReader { return &csvReader{comma: '\t', lazyQuotes: true} },
+	"json": func() sourceReader { return &jsonReader{} },
+	"yaml": func() sourceReader { return &yamlReader{} },
+	"xlsx": func() sourceReader { return &xlsxReader{} },
+}
+
+var sourceExtensions = map[string]string{
+	".csv":  "csv",
+	".tsv":  "tsv",
+	".tab":  "tsv",
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".xlsx": "xlsx",
+}
+
+// getSourceReader returns the reader for format or, when format is empty,
+// for the extension of filename. Files with other extensions are read as
+// CSV.
+func getSourceReader(format, filename string) (sourceReader, error) {
+	if format == "" {
+		format = sourceExtensions[strings.ToLower(filepath.Ext(filename))]
+	}
+	if format == "" {
+		format = "csv"
+	}
+	reader, ok := sourceFormats[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return reader(), nil
+}
+
+// validateFormat is a validation function for the "format" attribute.
+func validateFormat(v interface{}, k string) (ws []string, errors []error) {
+	if _, ok := sourceFormats[v.(string)]; !ok {
+		formats := make([]string, 0, len(sourceFormats))
+		for f := range sourceFormats {
+			formats = append(formats, f)
+		}
+		sort.Strings(formats)
+		errors = append(errors, fmt.Errorf("%q must be one of %s", k, strings.Join(formats, ", ")))
+	}
+	return
+}
+
+// readRows reads an inventory into rows keyed by column name. Known columns
+// are validated and converted to their declared types and the rest are
+// collected into "extra"; every invalid value is reported in the returned
+// error. The columns of the source are returned along with the rows, and
+// the position of each row in the source, e.g. "line 3", alongside it for
+// later error messages.
+func readRows(reader sourceReader, data []byte, columns []string) ([]string, []map[string]interface{}, []string, error) {
+	columns, raws, err := reader.read(data, columns)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	rows := make([]map[string]interface{}, 0, len(raws))
+	where := make([]string, 0, len(raws))
+	if len(columns) == 0 && len(raws) == 0 {
+		return columns, rows, where, nil
+	}
+	if err := checkColumns(columns); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var errors *multierror.Error
+	for _, r := range raws {
+		raw := make(map[string]string, len(columns))
+		extra := make(map[string]interface{})
+		for _, k := range columns {
+			if !isKnownColumn(k) {
+				// unrecognised columns are passed through untouched
+				if k != "" {
+					extra[k] = r.values[k]
+				}
+				continue
+			}
+			raw[k] = r.values[k]
+		}
+
+		row, rowErrors := convertRow(raw)
+		for _, err := range rowErrors {
+			errors = multierror.Append(errors, fmt.Errorf("%s (%s): %s", r.where, raw["hostname"], err))
+		}
+		row["extra"] = extra
+		if _, ok := row["expires"]; !ok {
+			row["expires"] = ""
+		}
+		rows = append(rows, row)
+		where = append(where, r.where)
+	}
+	if err := errors.ErrorOrNil(); err != nil {
+		return nil, nil, nil, err
+	}
+	return columns, rows, where, nil
+}
+
+// jsonReader reads a JSON list of objects, one per host.
+type jsonReader struct{}
+
+func (r *jsonReader) read(data []byte, columns []string) ([]string, []rawRow, error) {
+	if len(columns) > 0 {
+		return nil, nil, fmt.Errorf("columns can't be used with the json format")
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+
+	entries := make([]map[string]interface{}, 0)
+	if err := decoder.Decode(&entries); err != nil {
+		return nil, nil, fmt.Errorf("expected a list of objects: %s", err)
+	}
+	return readObjects(entries)
+}
+
+// yamlReader reads a YAML list of mappings, one per host.
+type yamlReader struct{}
+
+func (r *yamlReader) read(data []byte, columns []string) ([]string, []rawRow, error) {
+	if len(columns) > 0 {
+		return nil, nil, fmt.Errorf("columns can't be used with the yaml format")
+	}
+	// values are read as the text they were written as, so that
+	// "hostname: 0123" isn't read as the octal number 83
+	mappings := make([]map[string]string, 0)
+	if err := yaml.Unmarshal(data, &mappings); err != nil {
+		return nil, nil, fmt.Errorf("expected a list of mappings of single values: %s", err)
+	}
+	entries := make([]map[string]interface{}, len(mappings))
+	for i, mapping := range mappings {
+		entries[i] = make(map[string]interface{}, len(mapping))
+		for k, v := range mapping {
+			entries[i][k] = v
+		}
+	}
+	return readObjects(entries)
+}
+
+// readObjects turns a list of objects into rows. The columns are every key
+// used by any of the objects; keys have no order within an object, so each
+// object's new keys are added in name order.
+func readObjects(entries []map[string]interface{}) ([]string, []rawRow, error) {
+	columns := make([]string, 0)
+	seen := make(map[string]bool)
+	rows := make([]rawRow, 0, len(entries))
+	for i, entry := range entries {
+		// map order is random, so sort the keys of each entry
+		keys := make([]string, 0, len(entry))
+		for k := range entry {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		values := make(map[string]string, len(entry))
+		for _, k := range keys {
+			name := strings.ToLower(strings.TrimSpace(k))
+			value, err := objectValue(entry[k])
+			if err != nil {
+				return nil, nil, fmt.Errorf("entry %d: %q %s", i+1, k, err)
+			}
+			values[name] = value
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+		rows = append(rows, rawRow{where: fmt.Sprintf("entry %d", i+1), values: values})
+	}
+	return columns, rows, nil
+}
+
+func objectValue(v interface{}) (string, error) {
+	switch value := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(value), nil
+	}
+	return "", fmt.Errorf("must be a single value, got %T", v)
+}
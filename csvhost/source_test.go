@@ -0,0 +1,145 @@
+package csvhost
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGetSourceReader(t *testing.T) {
+	cases := []struct {
+		format, filename string
+		want             sourceReader
+	}{
+		{"", "hosts.csv", &csvReader{comma: ','}},
+		{"", "hosts.TSV", &csvReader{comma: '\t', lazyQuotes: true}},
+		{"", "hosts.yml", &yamlReader{}},
+		{"", "hosts.json", &jsonReader{}},
+		{"", "hosts.xlsx", &xlsxReader{}},
+		{"", "hosts.txt", &csvReader{comma: ','}},
+		{"json", "hosts.csv", &jsonReader{}},
+	}
+
+	for _, tc := range cases {
+		reader, err := getSourceReader(tc.format, tc.filename)
+		if err != nil {
+			t.Errorf("%s: %s", tc.filename, err)
+			continue
+		}
+		if !reflect.DeepEqual(reader, tc.want) {
+			t.Errorf("%s: got %#v; want %#v", tc.filename, reader, tc.want)
+		}
+	}
+
+	if _, err := getSourceReader("ods", "hosts.ods"); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+func TestReadRows_tsv(t *testing.T) {
+	data := []byte("hostname\taddress\tgateway\tsubnet\tcpu\tmemory\tvapp\tnetwork\ttemplate\n" +
+		"web01\t10.0.0.10\t10.0.0.1\t24\t2\t4096\tweb\tvlan10\tsmall \"v2\"\n")
+
+	_, rows, _, err := readRows(sourceFormats["tsv"](), data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 1 || rows[0]["template"] != `small "v2"` {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+func TestReadRows_json(t *testing.T) {
+	data := []byte(`[
+		{"hostname": "web01", "address": "10.0.0.10", "gateway": "10.0.0.1", "subnet": 24,
+		 "cpu": 2, "memory": 4096, "vapp": "web", "network": "vlan10", "template": "small",
+		 "owner": "ops"},
+		{"hostname": "web02", "address": "10.0.0.11", "gateway": null, "subnet": 24,
+		 "cpu": 4, "memory": 8192, "vapp": "web", "network": "vlan10", "template": "large"}
+	]`)
+
+	_, rows, _, err := readRows(&jsonReader{}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 2 || rows[0]["cpu"] != 2 || rows[1]["memory"] != 8192 || rows[1]["gateway"] != "" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+	if rows[0]["extra"].(map[string]interface{})["owner"] != "ops" {
+		t.Fatalf("extra column missing: %v", rows[0])
+	}
+
+	_, _, _, err = readRows(&jsonReader{}, []byte(`[{"hostname": {"name": "web01"}}]`), nil)
+	if err == nil || !strings.Contains(err.Error(), "entry 1") {
+		t.Fatalf("expected an error naming the entry, got %v", err)
+	}
+}
+
+func TestReadRows_yaml(t *testing.T) {
+	data := []byte(`
+- hostname: web01
+  address: 10.0.0.10
+  gateway: 10.0.0.1
+  subnet: 24
+  cpu: 2
+  memory: 4096
+  vapp: web
+  network: vlan10
+  template: small
+  expires: 2030-01-01
+- hostname: web02
+  address: 10.0.0.11
+  gateway: 10.0.0.1
+  subnet: 24
+  cpu: 0
+  memory: 4096
+  vapp: web
+  network: vlan10
+  template: small
+`)
+
+	_, _, _, err := readRows(&yamlReader{}, data, nil)
+	if err == nil || !strings.Contains(err.Error(), `entry 2 (web02): column "cpu"`) {
+		t.Fatalf("expected a validation error for entry 2, got %v", err)
+	}
+
+	_, rows, _, err := readRows(&yamlReader{}, []byte(strings.Replace(string(data), "cpu: 0", "cpu: 1", 1)), nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if rows[0]["expires"] != "2030-01-01" || rows[0]["hostname"] != "web01" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+}
+
+func TestReadRows_yamlText(t *testing.T) {
+	data := []byte(`
+- hostname: 0123
+  address: 10.0.0.10
+  gateway: 10.0.0.1
+  subnet: 24
+  cpu: 2
+  memory: 4096
+  vapp: web
+  network: vlan10
+  template: small
+  expires: 2030-01-01T12:00:00Z
+  owner: ~
+`)
+
+	_, rows, _, err := readRows(&yamlReader{}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if rows[0]["hostname"] != "0123" || rows[0]["expires"] != "2030-01-01T12:00:00Z" {
+		t.Fatalf("values not read as written: %v", rows[0])
+	}
+	if owner := rows[0]["extra"].(map[string]interface{})["owner"]; owner != "" {
+		t.Fatalf("null read as %q", owner)
+	}
+
+	nested := []byte(strings.Replace(string(data), "owner: ~", "owner: [ops, dev]", 1))
+	if _, _, _, err := readRows(&yamlReader{}, nested, nil); err == nil {
+		t.Fatal("expected an error for a list value")
+	}
+}
@@ -3,6 +3,7 @@ package csvhost
 import (
 	"fmt"
 	"os/exec"
+	"unicode/utf8"
 )
 
 // validateProgramAttr is a validation function for the "program" attribute we
@@ -33,3 +34,24 @@ func validateProgramAttr(v interface{}) error {
 
 	return nil
 }
+
+// validateNonNegative is a validation function for integer attributes that
+// can't be negative.
+func validateNonNegative(v interface{}, k string) (ws []string, errors []error) {
+	if v.(int) < 0 {
+		errors = append(errors, fmt.Errorf("%q must not be negative, got %d", k, v.(int)))
+	}
+	return
+}
+
+// validateSingleCharacter is a validation function for attributes holding a
+// single character, such as a delimiter.
+func validateSingleCharacter(v interface{}, k string) (ws []string, errors []error) {
+	value := v.(string)
+	if utf8.RuneCountInString(value) != 1 {
+		errors = append(errors, fmt.Errorf("%q must be a single character, got %q", k, value))
+	} else if r, _ := utf8.DecodeRuneInString(value); r == '"' || r == '\r' || r == '\n' || r == utf8.RuneError {
+		errors = append(errors, fmt.Errorf("%q can't be %q", k, value))
+	}
+	return
+}
@@ -0,0 +1,222 @@
+package csvhost
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// xlsxReader reads the first worksheet of an Excel workbook. Like CSV, the
+// first row names the columns.
+type xlsxReader struct {
+	skipRows int
+}
+
+type xlsxWorkbook struct {
+	Sheets []struct {
+		Name string `xml:"name,attr"`
+		ID   string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+	} `xml:"sheets>sheet"`
+}
+
+type xlsxRelationships struct {
+	Relationships []struct {
+		ID     string `xml:"Id,attr"`
+		Target string `xml:"Target,attr"`
+	} `xml:"Relationship"`
+}
+
+// xlsxText is a string that is either plain or made of formatted runs.
+type xlsxText struct {
+	T    string `xml:"t"`
+	Runs []struct {
+		T string `xml:"t"`
+	} `xml:"r"`
+}
+
+func (t xlsxText) String() string {
+	if len(t.Runs) == 0 {
+		return t.T
+	}
+	parts := make([]string, len(t.Runs))
+	for i, r := range t.Runs {
+		parts[i] = r.T
+	}
+	return strings.Join(parts, "")
+}
+
+type xlsxSharedStrings struct {
+	Items []xlsxText `xml:"si"`
+}
+
+type xlsxWorksheet struct {
+	Rows []struct {
+		R     int `xml:"r,attr"`
+		Cells []struct {
+			R  string   `xml:"r,attr"`
+			T  string   `xml:"t,attr"`
+			V  string   `xml:"v"`
+			Is xlsxText `xml:"is"`
+		} `xml:"c"`
+	} `xml:"sheetData>row"`
+}
+
+func (r *xlsxReader) read(data []byte, columns []string) ([]string, []rawRow, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("not an xlsx workbook: %s", err)
+	}
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+
+	sheetPath, err := xlsxFirstSheet(files)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var shared xlsxSharedStrings
+	if _, ok := files["xl/sharedStrings.xml"]; ok {
+		if err := xlsxDecode(files, "xl/sharedStrings.xml", &shared); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var sheet xlsxWorksheet
+	if err := xlsxDecode(files, sheetPath, &sheet); err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]tableRecord, 0, len(sheet.Rows))
+	width := len(columns)
+	for i, row := range sheet.Rows {
+		line := row.R
+		if line == 0 {
+			line = i + 1
+		}
+
+		fields := make([]string, 0)
+		for j, cell := range row.Cells {
+			index := j
+			if cell.R != "" {
+				if index, err = xlsxColumnIndex(cell.R); err != nil {
+					return nil, nil, fmt.Errorf("line %d: %s", line, err)
+				}
+			}
+			for len(fields) <= index {
+				fields = append(fields, "")
+			}
+
+			switch cell.T {
+			case "s":
+				n, err := strconv.Atoi(cell.V)
+				if err != nil || n < 0 || n >= len(shared.Items) {
+					return nil, nil, fmt.Errorf("line %d: cell %s refers to a missing shared string", line, cell.R)
+				}
+				fields[index] = shared.Items[n].String()
+			case "inlineStr":
+				fields[index] = cell.Is.String()
+			case "b":
+				fields[index] = strconv.FormatBool(cell.V == "1")
+			default:
+				fields[index] = cell.V
+			}
+		}
+
+		if line <= r.skipRows || xlsxEmpty(fields) {
+			continue
+		}
+		if width == 0 {
+			width = len(fields)
+		}
+		// rows are stored without their trailing blank cells
+		for len(fields) < width {
+			fields = append(fields, "")
+		}
+		for len(fields) > width && fields[len(fields)-1] == "" {
+			fields = fields[:len(fields)-1]
+		}
+		records = append(records, tableRecord{line: line, fields: fields})
+	}
+	return readTable(records, columns)
+}
+
+// xlsxFirstSheet returns the path of the first worksheet in the workbook.
+func xlsxFirstSheet(files map[string]*zip.File) (string, error) {
+	var workbook xlsxWorkbook
+	if err := xlsxDecode(files, "xl/workbook.xml", &workbook); err != nil {
+		return "", err
+	}
+	if len(workbook.Sheets) == 0 {
+		return "", fmt.Errorf("workbook has no sheets")
+	}
+
+	var rels xlsxRelationships
+	if err := xlsxDecode(files, "xl/_rels/workbook.xml.rels", &rels); err != nil {
+		return "", err
+	}
+	for _, rel := range rels.Relationships {
+		if rel.ID != workbook.Sheets[0].ID {
+			continue
+		}
+		if strings.HasPrefix(rel.Target, "/") {
+			return strings.TrimPrefix(rel.Target, "/"), nil
+		}
+		return path.Join("xl", rel.Target), nil
+	}
+	return "", fmt.Errorf("workbook has no worksheet for sheet %q", workbook.Sheets[0].Name)
+}
+
+func xlsxDecode(files map[string]*zip.File, name string, v interface{}) error {
+	f, ok := files[name]
+	if !ok {
+		return fmt.Errorf("workbook has no %s", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %s", name, err)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %s", name, err)
+	}
+	if err := xml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse %s: %s", name, err)
+	}
+	return nil
+}
+
+// xlsxColumnIndex returns the zero based column of a cell reference such as
+// "AB12".
+func xlsxColumnIndex(ref string) (int, error) {
+	index := 0
+	letters := 0
+	for _, r := range strings.ToUpper(ref) {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		index = index*26 + int(r-'A'+1)
+		letters++
+	}
+	if letters == 0 {
+		return 0, fmt.Errorf("invalid cell reference %q", ref)
+	}
+	return index - 1, nil
+}
+
+func xlsxEmpty(fields []string) bool {
+	for _, f := range fields {
+		if strings.TrimSpace(f) != "" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,98 @@
+package csvhost
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+func testWorkbook(t *testing.T, sheet string) []byte {
+	files := map[string]string{
+		"xl/workbook.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"
+          xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">
+  <sheets><sheet name="Hosts" sheetId="1" r:id="rId3"/></sheets>
+</workbook>`,
+		"xl/_rels/workbook.xml.rels": `<?xml version="1.0" encoding="UTF-8"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">
+  <Relationship Id="rId1" Type="sharedStrings" Target="sharedStrings.xml"/>
+  <Relationship Id="rId3" Type="worksheet" Target="worksheets/hosts.xml"/>
+</Relationships>`,
+		"xl/sharedStrings.xml": `<?xml version="1.0" encoding="UTF-8"?>
+<sst xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+  <si><t>hostname</t></si>
+  <si><t>address</t></si>
+  <si><r><t>web</t></r><r><t>01</t></r></si>
+</sst>`,
+		"xl/worksheets/hosts.xml": sheet,
+	}
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestXLSXReader(t *testing.T) {
+	data := testWorkbook(t, `<?xml version="1.0" encoding="UTF-8"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main">
+  <sheetData>
+    <row r="1">
+      <c r="A1" t="s"><v>0</v></c><c r="B1" t="s"><v>1</v></c>
+      <c r="C1" t="inlineStr"><is><t>gateway</t></is></c><c r="D1" t="inlineStr"><is><t>subnet</t></is></c>
+      <c r="E1" t="inlineStr"><is><t>cpu</t></is></c><c r="F1" t="inlineStr"><is><t>memory</t></is></c>
+      <c r="G1" t="inlineStr"><is><t>vapp</t></is></c><c r="H1" t="inlineStr"><is><t>network</t></is></c>
+      <c r="I1" t="inlineStr"><is><t>template</t></is></c><c r="J1" t="inlineStr"><is><t>Owner</t></is></c>
+    </row>
+    <row r="2">
+      <c r="A2" t="s"><v>2</v></c><c r="B2" t="str"><v>10.0.0.10</v></c>
+      <c r="D2"><v>24</v></c><c r="E2"><v>2</v></c><c r="F2"><v>4096</v></c>
+      <c r="G2" t="inlineStr"><is><t>web</t></is></c><c r="H2" t="inlineStr"><is><t>vlan10</t></is></c>
+      <c r="I2" t="inlineStr"><is><t>small</t></is></c>
+    </row>
+    <row r="3"></row>
+  </sheetData>
+</worksheet>`)
+
+	_, rows, _, err := readRows(&xlsxReader{}, data, nil)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(rows) != 1 {
+		t.Fatalf("expected 1 row, got %d: %v", len(rows), rows)
+	}
+	row := rows[0]
+	if row["hostname"] != "web01" || row["address"] != "10.0.0.10" || row["gateway"] != "" || row["cpu"] != 2 {
+		t.Fatalf("unexpected row: %v", row)
+	}
+	if owner, ok := row["extra"].(map[string]interface{})["owner"]; !ok || owner != "" {
+		t.Fatalf("expected a blank owner, got %v", row["extra"])
+	}
+}
+
+func TestXLSXReader_notWorkbook(t *testing.T) {
+	if _, _, err := (&xlsxReader{}).read([]byte("hostname,address\n"), nil); err == nil {
+		t.Fatal("expected an error reading CSV as xlsx")
+	}
+}
+
+func TestXLSXColumnIndex(t *testing.T) {
+	cases := map[string]int{"A1": 0, "Z9": 25, "AA10": 26, "AB2": 27}
+	for ref, want := range cases {
+		got, err := xlsxColumnIndex(ref)
+		if err != nil || got != want {
+			t.Errorf("%s: got %d, %v; want %d", ref, got, err, want)
+		}
+	}
+}